@@ -1,20 +1,23 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 )
 
-type usageResponse struct {
-	Entries []usageEntry `json:"entries"`
-}
+// usageTimeFormat is the format of the start and end times of usage log queries
+const usageTimeFormat = "2006-01-02 15:04:05"
 
 type usageEntry struct {
 	User    string             `json:"user"`
@@ -22,8 +25,10 @@ type usageEntry struct {
 }
 
 type bucketUsageEntry struct {
-	ID         string               `json:"bucket"`
-	Owner      string               `json:"owner"`
+	ID    string `json:"bucket"`
+	Owner string `json:"owner"`
+	// Epoch is the start of the hour the entry covers, in seconds since the unix epoch
+	Epoch      int64                `json:"epoch"`
 	Categories []usageCategoryEntry `json:"categories"`
 }
 
@@ -35,7 +40,15 @@ type usageCategoryEntry struct {
 	SuccessfulOps int64  `json:"successful_ops"`
 }
 
-func getCephUsageStats(client *http.Client, rgwURL *url.URL, creds *credentials.Credentials) (*usageResponse, error) {
+// usageSummaryEntry is the summary of the usage of a user, across all its buckets
+type usageSummaryEntry struct {
+	User  string             `json:"user"`
+	Total usageCategoryEntry `json:"total"`
+}
+
+// usageURL returns the URL of the usage log. It either returns the entries of each bucket and hour, or the summary of each user
+// If `start` is not zero, only the usage of the hours from `start` onwards is returned
+func usageURL(rgwURL *url.URL, summary bool, start time.Time) (*url.URL, error) {
 	destURL, err := rgwURL.Parse("admin/usage")
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
@@ -43,21 +56,82 @@ func getCephUsageStats(client *http.Client, rgwURL *url.URL, creds *credentials.
 
 	queryParams := destURL.Query()
 	queryParams.Add("format", "json")
-	queryParams.Add("show-entries", "True")
-	queryParams.Add("show-summary", "False")
+	if summary {
+		queryParams.Add("show-entries", "False")
+		queryParams.Add("show-summary", "True")
+	} else {
+		queryParams.Add("show-entries", "True")
+		queryParams.Add("show-summary", "False")
+	}
+	if !start.IsZero() {
+		queryParams.Add("start", start.UTC().Format(usageTimeFormat))
+	}
 	destURL.RawQuery = queryParams.Encode()
 
-	resp, err := queryCephAdminAPI(client, destURL, creds)
+	return destURL, nil
+}
+
+// getCephUsageStats streams the usage log entries from Ceph, calling fn with each entry as it is decoded
+// This avoids holding the whole usage log, which can be very large, in memory at once
+// If `start` is not zero, only the entries of the hours from `start` onwards are fetched
+func getCephUsageStats(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, start time.Time, fn func(entry usageEntry) error) error {
+	destURL, err := usageURL(rgwURL, false, start)
+	if err != nil {
+		return err
+	}
+
+	err = streamCephAdminAPI(ctx, client, destURL, signer, func(dec *json.Decoder) error {
+		return decodeJSONObject(dec, func(key string) error {
+			if key != "entries" {
+				return skipJSONValue(dec)
+			}
+
+			return decodeJSONArray(dec, func() error {
+				entry := usageEntry{}
+				if err := dec.Decode(&entry); err != nil {
+					return err
+				}
+
+				return fn(entry)
+			})
+		})
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get usage stats from ceph - %w", err)
+		return fmt.Errorf("failed to get usage stats from ceph - %w", err)
 	}
 
-	usage := &usageResponse{}
-	if err := json.Unmarshal(resp, usage); err != nil {
-		return nil, fmt.Errorf("failed to unmarshall ceph usage response - %w", err)
+	return nil
+}
+
+// getCephUsageSummary streams the usage summary of each user from Ceph, calling fn with each user as it is decoded
+// The summary is much smaller than the usage log entries, since it isn't broken down by bucket and hour
+func getCephUsageSummary(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, fn func(entry usageSummaryEntry) error) error {
+	destURL, err := usageURL(rgwURL, true, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	err = streamCephAdminAPI(ctx, client, destURL, signer, func(dec *json.Decoder) error {
+		return decodeJSONObject(dec, func(key string) error {
+			if key != "summary" {
+				return skipJSONValue(dec)
+			}
+
+			return decodeJSONArray(dec, func() error {
+				entry := usageSummaryEntry{}
+				if err := dec.Decode(&entry); err != nil {
+					return err
+				}
+
+				return fn(entry)
+			})
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get usage summary from ceph - %w", err)
 	}
 
-	return usage, nil
+	return nil
 }
 
 type bucketInfoEntry struct {
@@ -81,109 +155,373 @@ type bucketQuotaEntry struct {
 	MaxObjects int64 `json:"max_objects"`
 }
 
-func getCephBucketStats(client *http.Client, rgwURL *url.URL, creds *credentials.Credentials) ([]bucketInfoEntry, error) {
+// getCephBucketStats streams the stats of every bucket from Ceph, calling fn with each bucket as it is decoded
+// If `pageSize` is positive, the users are listed page by page and the buckets of each user are fetched
+// separately, using up to `concurrency` requests in parallel. This keeps every response small on clusters
+// with a very large number of buckets. Otherwise, all the buckets are fetched in a single request
+// In paged mode, only the buckets of the users kept by `userFilter` are fetched. Otherwise, fn must filter the owners itself
+// fn is never called concurrently
+func getCephBucketStats(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, userFilter *NameFilter, pageSize int, concurrency int, fn func(bucket bucketInfoEntry)) error {
+	if pageSize <= 0 {
+		return getCephBucketStatsPage(ctx, client, rgwURL, signer, "", fn)
+	}
+
+	var fnMutex sync.Mutex
+	lockedFn := func(bucket bucketInfoEntry) {
+		fnMutex.Lock()
+		defer fnMutex.Unlock()
+
+		fn(bucket)
+	}
+
+	return forEachUserPage(ctx, client, rgwURL, signer, pageSize, func(page []string) error {
+		// Filter the users before fetching their buckets, so we don't make requests for users we won't export
+		users := make([]string, 0, len(page))
+		for _, user := range page {
+			if userFilter.Keep(user) {
+				users = append(users, user)
+			}
+		}
+
+		var mutex sync.Mutex
+		var firstErr error
+
+		forEachConcurrently(ctx, users, concurrency, func(user string) {
+			err := getCephBucketStatsPage(ctx, client, rgwURL, signer, user, lockedFn)
+			if err == nil {
+				return
+			}
+
+			var apiErr *adminAPIError
+			if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+				// The user was deleted after we listed it
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		})
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to get bucket stats from ceph - %w", ctx.Err())
+		}
+		return firstErr
+	})
+}
+
+// getCephBucketStatsPage streams the stats of the buckets owned by `user`, or of all buckets if `user` is empty
+func getCephBucketStatsPage(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, user string, fn func(bucket bucketInfoEntry)) error {
 	destURL, err := rgwURL.Parse("admin/bucket")
 	if err != nil {
-		return nil, fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
+		return fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
 	}
 
 	queryParams := destURL.Query()
 	queryParams.Add("format", "json")
 	queryParams.Add("stats", "True")
+	if user != "" {
+		queryParams.Add("uid", user)
+	}
 	destURL.RawQuery = queryParams.Encode()
 
-	resp, err := queryCephAdminAPI(client, destURL, creds)
+	err = streamCephAdminAPI(ctx, client, destURL, signer, func(dec *json.Decoder) error {
+		return decodeJSONArray(dec, func() error {
+			bucket := bucketInfoEntry{}
+			if err := dec.Decode(&bucket); err != nil {
+				return err
+			}
+
+			fn(bucket)
+			return nil
+		})
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get bucket stats from ceph - %w", err)
+		return fmt.Errorf("failed to get bucket stats from ceph - %w", err)
 	}
 
-	bucketStats := []bucketInfoEntry{}
-	if err := json.Unmarshal(resp, &bucketStats); err != nil {
-		return nil, fmt.Errorf("failed to unmarshall ceph bucket response - %w", err)
-	}
+	return nil
+}
 
-	return bucketStats, nil
+type userInfoEntry struct {
+	UserID string          `json:"user_id"`
+	Quota  userQuotaEntry  `json:"user_quota"`
+	Stats  *userStatsEntry `json:"stats"`
 }
 
-type userStats struct {
+type userQuotaEntry struct {
 	Enabled    bool  `json:"enabled"`
 	MaxSize    int64 `json:"max_size"`
 	MaxObjects int64 `json:"max_objects"`
 }
 
-func getCephUserQuotaStats(client *http.Client, rgwURL *url.URL, creds *credentials.Credentials) (map[string]userStats, error) {
-	users, err := getUserList(client, rgwURL, creds)
+type userStatsEntry struct {
+	Size         uint64 `json:"size_actual"`
+	UtilizedSize uint64 `json:"size_utilized"`
+	NumObjects   uint64 `json:"num_objects"`
+}
+
+// getCephUserQuotaStats fetches the info of every user kept by `filter`, using up to `concurrency` requests in parallel
+// Failing to fetch the info of a single user is not fatal. Those users are left out of the returned map,
+// and their errors are returned in the userFetchErrors instead
+func getCephUserQuotaStats(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, filter *NameFilter, syncStats bool, pageSize int, concurrency int) (map[string]userInfoEntry, userFetchErrors, error) {
+	allUsers, err := getUserList(ctx, client, rgwURL, signer, pageSize)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	// Filter the users before fetching their info, so we don't make requests for users we won't export
+	users := make([]string, 0, len(allUsers))
+	for _, user := range allUsers {
+		if filter.Keep(user) {
+			users = append(users, user)
+		}
+	}
+
+	var mutex sync.Mutex
+	statsMap := map[string]userInfoEntry{}
+	failures := userFetchErrors{}
+
+	forEachConcurrently(ctx, users, concurrency, func(user string) {
+		info, err := getCephUserInfo(ctx, client, rgwURL, signer, user, syncStats)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err != nil {
+			failures[user] = err
+		} else {
+			statsMap[user] = info
+		}
+	})
+
+	if ctx.Err() != nil {
+		return nil, nil, fmt.Errorf("failed to get user stats from ceph - %w", ctx.Err())
+	}
+
+	return statsMap, failures, nil
+}
+
+func getCephUserInfo(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, user string, syncStats bool) (userInfoEntry, error) {
+	destURL, err := rgwURL.Parse("admin/user")
+	if err != nil {
+		return userInfoEntry{}, fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
+	}
+
+	// The user info response contains both the user quota and, with stats=True, the storage usage of the user
+	queryParams := destURL.Query()
+	queryParams.Add("format", "json")
+	queryParams.Add("uid", user)
+	queryParams.Add("stats", "True")
+	if syncStats {
+		// Ask RGW to sync the user stats from the bucket indexes before returning them
+		queryParams.Add("sync", "True")
+	}
+	destURL.RawQuery = queryParams.Encode()
+
+	resp, err := queryCephAdminAPI(ctx, client, destURL, signer)
+	if err != nil {
+		return userInfoEntry{}, fmt.Errorf("failed to get user stats from ceph - %w", err)
+	}
+
+	info := userInfoEntry{}
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return userInfoEntry{}, fmt.Errorf("failed to unmarshall ceph user stats response - %w", err)
+	}
+
+	return info, nil
+}
+
+// userFetchErrors holds the error of each user whose info could not be fetched
+type userFetchErrors map[string]error
+
+// Reasons a user's info could not be fetched
+const (
+	userFetchReasonNotFound = "not_found"
+	userFetchReasonTimeout  = "timeout"
+	userFetchReasonError    = "error"
+)
+
+// userFetchErrorReason classifies a user fetch error for the `reason` label of radosgw_usage_user_fetch_errors_total
+func userFetchErrorReason(err error) string {
+	var apiErr *adminAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		// The user was most likely deleted between listing the users and fetching its info
+		return userFetchReasonNotFound
+	}
+	if isTimeoutError(err) {
+		return userFetchReasonTimeout
+	}
+
+	return userFetchReasonError
+}
+
+func (e userFetchErrors) Error() string {
+	users := make([]string, 0, len(e))
+	for user := range e {
+		users = append(users, user)
 	}
+	sort.Strings(users)
 
-	statsMap := map[string]userStats{}
+	failures := make([]string, 0, len(users))
 	for _, user := range users {
+		failures = append(failures, fmt.Sprintf("user `%s`: %v", user, e[user]))
+	}
+
+	return fmt.Sprintf("failed to get stats for %d users - %s", len(e), strings.Join(failures, "; "))
+}
+
+type userListResponse struct {
+	Keys      []string `json:"keys"`
+	Truncated bool     `json:"truncated"`
+	Marker    string   `json:"marker"`
+}
+
+// getUserList fetches the IDs of all the users. See forEachUserPage for `pageSize`
+func getUserList(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, pageSize int) ([]string, error) {
+	users := []string{}
+	err := forEachUserPage(ctx, client, rgwURL, signer, pageSize, func(page []string) error {
+		users = append(users, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// forEachUserPage lists the users at most `pageSize` at a time, and calls fn with each page of user IDs
+// If `pageSize` is not positive, all the users are listed in a single request
+func forEachUserPage(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, pageSize int, fn func(users []string) error) error {
+	marker := ""
+	for {
 		destURL, err := rgwURL.Parse("admin/user")
 		if err != nil {
-			return nil, fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
+			return fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
 		}
 
 		queryParams := destURL.Query()
 		queryParams.Add("format", "json")
-		queryParams.Add("quota", "")
-		queryParams.Add("uid", user)
-		queryParams.Add("quota-type", "user")
+		queryParams.Add("list", "")
+		if pageSize > 0 {
+			queryParams.Add("max-entries", strconv.Itoa(pageSize))
+		}
+		if marker != "" {
+			queryParams.Add("marker", marker)
+		}
 		destURL.RawQuery = queryParams.Encode()
 
-		resp, err := queryCephAdminAPI(client, destURL, creds)
+		resp, err := queryCephAdminAPI(ctx, client, destURL, signer)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get user stats from ceph - %w", err)
+			return fmt.Errorf("failed to get user list from ceph - %w", err)
 		}
 
-		stats := userStats{}
-		if err := json.Unmarshal(resp, &stats); err != nil {
-			return nil, fmt.Errorf("failed to unmarshall ceph user stats response - %w", err)
+		userList := &userListResponse{}
+		if err := json.Unmarshal(resp, userList); err != nil {
+			return fmt.Errorf("failed to unmarshall ceph user list response - %w", err)
 		}
 
-		statsMap[user] = stats
-	}
+		if err := fn(userList.Keys); err != nil {
+			return err
+		}
 
-	return statsMap, nil
+		// Guard against a server that claims to be truncated without moving the marker forward
+		if !userList.Truncated || userList.Marker == "" || userList.Marker == marker {
+			return nil
+		}
+		marker = userList.Marker
+	}
 }
 
-type userListResponse struct {
-	Keys []string `json:"keys"`
+// forEachConcurrently calls fn for every item, running up to `concurrency` calls in parallel
+// It stops handing out new items once ctx is cancelled
+func forEachConcurrently(ctx context.Context, items []string, concurrency int, fn func(item string)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	itemChan := make(chan string)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for item := range itemChan {
+				fn(item)
+			}
+		}()
+	}
+
+feedLoop:
+	for _, item := range items {
+		select {
+		case itemChan <- item:
+		case <-ctx.Done():
+			break feedLoop
+		}
+	}
+	close(itemChan)
+	wg.Wait()
 }
 
-func getUserList(client *http.Client, rgwURL *url.URL, creds *credentials.Credentials) ([]string, error) {
-	destURL, err := rgwURL.Parse("admin/user")
+func queryCephAdminAPI(ctx context.Context, client *http.Client, destURL *url.URL, signer *requestSigner) ([]byte, error) {
+	resp, err := doCephAdminRequest(ctx, client, destURL, signer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to construct admin URL from ceph URL - %w", err)
+		return nil, err
 	}
 
-	queryParams := destURL.Query()
-	queryParams.Add("format", "json")
-	queryParams.Add("list", "")
-	destURL.RawQuery = queryParams.Encode()
+	respBody, err := io.ReadAll(resp.Body)
+
+	closeErr := resp.Body.Close()
 
-	resp, err := queryCephAdminAPI(client, destURL, creds)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user list from ceph - %w", err)
+		return nil, fmt.Errorf("failed to read response body - %w", err)
 	}
-
-	userList := &userListResponse{}
-	if err := json.Unmarshal(resp, userList); err != nil {
-		return nil, fmt.Errorf("failed to unmarshall ceph user list response - %w", err)
+	if closeErr != nil {
+		return nil, fmt.Errorf("failed to close response body - %w", closeErr)
 	}
 
-	return userList.Keys, nil
+	return respBody, nil
 }
 
-func queryCephAdminAPI(client *http.Client, destURL *url.URL, creds *credentials.Credentials) ([]byte, error) {
-	signer := v4.NewSigner(creds)
+// streamCephAdminAPI queries the admin API and calls fn with a decoder reading directly from the response body
+// Use this instead of queryCephAdminAPI for responses that can be too large to comfortably hold in memory
+func streamCephAdminAPI(ctx context.Context, client *http.Client, destURL *url.URL, signer *requestSigner, fn func(dec *json.Decoder) error) error {
+	resp, err := doCephAdminRequest(ctx, client, destURL, signer)
+	if err != nil {
+		return err
+	}
+
+	err = fn(json.NewDecoder(resp.Body))
+
+	closeErr := resp.Body.Close()
 
-	req, err := http.NewRequest("GET", destURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to decode response body - %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close response body - %w", closeErr)
+	}
+
+	return nil
+}
+
+// doCephAdminRequest sends a signed GET request to the admin API
+// If the server responds with 200, the response is returned and the caller must close its body
+// Otherwise, an *adminAPIError is returned
+func doCephAdminRequest(ctx context.Context, client *http.Client, destURL *url.URL, signer *requestSigner) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", destURL.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request - %w", err)
 	}
 
-	_, err = signer.Sign(req, nil, "s3", "us-east-1", time.Now())
+	err = signer.sign(req, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign request - %w", err)
 	}
@@ -193,6 +531,10 @@ func queryCephAdminAPI(client *http.Client, destURL *url.URL, creds *credentials
 		return nil, fmt.Errorf("failed to do request - %w", err)
 	}
 
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
 	respBody, err := io.ReadAll(resp.Body)
 
 	closeErr := resp.Body.Close()
@@ -204,9 +546,87 @@ func queryCephAdminAPI(client *http.Client, destURL *url.URL, creds *credentials
 		return nil, fmt.Errorf("failed to close response body - %w", closeErr)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned %s - Body: %s", resp.Status, respBody)
+	return nil, &adminAPIError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+}
+
+// decodeJSONObject reads a JSON object from dec, calling fn with each key
+// fn must consume the value of the key from dec
+func decodeJSONObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
 	}
 
-	return respBody, nil
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("expected an object key, got %v", token)
+		}
+
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return expectJSONDelim(dec, '}')
+}
+
+// decodeJSONArray reads a JSON array from dec, calling fn once per element
+// fn must consume the element from dec
+func decodeJSONArray(dec *json.Decoder, fn func() error) error {
+	if err := expectJSONDelim(dec, '['); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return expectJSONDelim(dec, ']')
+}
+
+// skipJSONValue reads and discards the next JSON value from dec
+func skipJSONValue(dec *json.Decoder) error {
+	var value json.RawMessage
+	return dec.Decode(&value)
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("expected `%v`, got %v", delim, token)
+	}
+
+	return nil
+}
+
+// adminAPIError is returned when the admin API responds with a non-200 status code
+type adminAPIError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *adminAPIError) Error() string {
+	return fmt.Sprintf("server returned %s - Body: %s", e.Status, e.Body)
+}
+
+// isTimeoutError returns true if err was caused by a request or scrape timeout
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
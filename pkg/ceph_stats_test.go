@@ -1,32 +1,256 @@
 package pkg
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCephRequest(t *testing.T) {
-	client := makeHTTPClient()
+	client := makeHTTPClient(time.Minute, nil)
 
 	//rgwURL, err := url.Parse("http://s3.ct.activision.com")
 	rgwURL, err := url.Parse("https://rgw.ct.activision.com")
 	require.NoError(t, err)
 
 	//creds := credentials.NewStaticCredentials("0I20MQBJE6RY4RBYD3Q1", "oKaKhtUIRHHTAyDPru4FIfoqJli38vVniqd2obax", "")
-	creds := credentials.NewStaticCredentials("2K2ZBA8G6Y380C7099OQ", "BfHkwnqG9Ro6cKTaocnWV8dWmr7hYOkAjSY7Otyp", "")
+	signer := newRequestSigner(credentials.NewStaticCredentials("2K2ZBA8G6Y380C7099OQ", "BfHkwnqG9Ro6cKTaocnWV8dWmr7hYOkAjSY7Otyp", ""), defaultSigningRegion, signatureV4)
 
-	usageStats, err := getCephUsageStats(client, rgwURL, creds)
+	err = getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error {
+		require.NotEmpty(t, entry.User)
+		return nil
+	})
 	require.NoError(t, err)
-	require.NotNil(t, usageStats)
 
-	bucketStats, err := getCephBucketStats(client, rgwURL, creds)
+	err = getCephBucketStats(context.Background(), client, rgwURL, signer, nil, 0, 4, func(bucket bucketInfoEntry) {
+		require.NotEmpty(t, bucket.Name)
+	})
 	require.NoError(t, err)
-	require.NotNil(t, bucketStats)
 
-	userQuotaStats, err := getCephUserQuotaStats(client, rgwURL, creds)
+	userQuotaStats, failures, err := getCephUserQuotaStats(context.Background(), client, rgwURL, signer, nil, false, 0, 4)
 	require.NoError(t, err)
+	require.Empty(t, failures)
 	require.NotNil(t, userQuotaStats)
 }
+
+// newFakeRGW starts a test server that answers admin API requests using `handler`
+func newFakeRGW(t *testing.T, handler http.HandlerFunc) *url.URL {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	rgwURL, err := url.Parse(srv.URL + "/")
+	require.NoError(t, err)
+
+	return rgwURL
+}
+
+func TestGetCephUserQuotaStatsConcurrent(t *testing.T) {
+	users := []string{"alice", "bob", "carol", "dave", "eve"}
+
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Has("list") {
+			require.NoError(t, json.NewEncoder(w).Encode(userListResponse{Keys: users}))
+			return
+		}
+
+		uid := query.Get("uid")
+		require.Equal(t, "True", query.Get("stats"))
+		fmt.Fprintf(w, `{"user_id": %q, "user_quota": {"enabled": true, "max_size": 1024, "max_objects": 10}, "stats": {"size_actual": %d, "size_utilized": 1, "num_objects": 2}}`, uid, len(uid))
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	stats, failures, err := getCephUserQuotaStats(context.Background(), client, rgwURL, signer, nil, false, 0, 3)
+	require.NoError(t, err)
+	require.Empty(t, failures)
+	require.Len(t, stats, len(users))
+
+	for _, user := range users {
+		require.Equal(t, user, stats[user].UserID)
+		require.True(t, stats[user].Quota.Enabled)
+		require.NotNil(t, stats[user].Stats)
+		require.Equal(t, uint64(len(user)), stats[user].Stats.Size)
+	}
+}
+
+func TestGetCephUserQuotaStatsPartialFailure(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Has("list") {
+			require.NoError(t, json.NewEncoder(w).Encode(userListResponse{Keys: []string{"alice", "deleted", "broken"}}))
+			return
+		}
+
+		switch uid := query.Get("uid"); uid {
+		case "deleted":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code": "NoSuchUser"}`)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprintf(w, `{"user_id": %q}`, uid)
+		}
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	stats, failures, err := getCephUserQuotaStats(context.Background(), client, rgwURL, signer, nil, false, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Contains(t, stats, "alice")
+
+	require.Len(t, failures, 2)
+	require.Equal(t, userFetchReasonNotFound, userFetchErrorReason(failures["deleted"]))
+	require.Equal(t, userFetchReasonError, userFetchErrorReason(failures["broken"]))
+}
+
+func TestGetCephBucketStatsPaginated(t *testing.T) {
+	users := []string{"alice", "bob", "carol", "dave", "eve"}
+
+	var mutex sync.Mutex
+	requestedUsers := []string{}
+
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		switch r.URL.Path {
+		case "/admin/user":
+			require.True(t, query.Has("list"))
+			require.Equal(t, "2", query.Get("max-entries"))
+
+			// Return the page of users following the marker
+			start := 0
+			if marker := query.Get("marker"); marker != "" {
+				for i, user := range users {
+					if user == marker {
+						start = i + 1
+					}
+				}
+			}
+			end := start + 2
+			if end > len(users) {
+				end = len(users)
+			}
+
+			page := userListResponse{Keys: users[start:end], Truncated: end < len(users)}
+			if page.Truncated {
+				page.Marker = users[end-1]
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(page))
+		case "/admin/bucket":
+			uid := query.Get("uid")
+			require.NotEmpty(t, uid)
+
+			mutex.Lock()
+			requestedUsers = append(requestedUsers, uid)
+			mutex.Unlock()
+
+			fmt.Fprintf(w, `[{"bucket": "%s-1", "owner": %q}, {"bucket": "%s-2", "owner": %q}]`, uid, uid, uid, uid)
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	bucketStats := []bucketInfoEntry{}
+	err := getCephBucketStats(context.Background(), client, rgwURL, signer, nil, 2, 2, func(bucket bucketInfoEntry) {
+		bucketStats = append(bucketStats, bucket)
+	})
+	require.NoError(t, err)
+	require.Len(t, bucketStats, 2*len(users))
+
+	bucketNames := []string{}
+	for _, bucket := range bucketStats {
+		require.Contains(t, bucket.Name, bucket.Owner)
+		bucketNames = append(bucketNames, bucket.Name)
+	}
+	for _, user := range users {
+		require.Contains(t, bucketNames, user+"-1")
+		require.Contains(t, bucketNames, user+"-2")
+	}
+
+	// The buckets of the filtered out users aren't requested at all
+	filter, err := NewNameFilter(nil, []string{"bob", "d.*"})
+	require.NoError(t, err)
+
+	requestedUsers = []string{}
+	bucketStats = []bucketInfoEntry{}
+	err = getCephBucketStats(context.Background(), client, rgwURL, signer, filter, 2, 2, func(bucket bucketInfoEntry) {
+		bucketStats = append(bucketStats, bucket)
+	})
+	require.NoError(t, err)
+	require.Len(t, bucketStats, 6)
+	require.ElementsMatch(t, []string{"alice", "carol", "eve"}, requestedUsers)
+}
+
+func TestGetCephUsageStatsStreaming(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/admin/usage", r.URL.Path)
+		fmt.Fprint(w, `{
+			"entries": [
+				{"user": "alice", "buckets": [{"bucket": "photos", "owner": "alice", "categories": [{"category": "get_obj", "ops": 3, "successful_ops": 2}]}]},
+				{"user": "bob", "buckets": []}
+			],
+			"summary": [{"user": "alice", "total": {"ops": 3}}]
+		}`)
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	entries := []usageEntry{}
+	err := getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "alice", entries[0].User)
+	require.Equal(t, int64(3), entries[0].Buckets[0].Categories[0].Ops)
+	require.Equal(t, "bob", entries[1].User)
+}
+
+func TestGetCephUsageSummary(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/admin/usage", r.URL.Path)
+		require.Equal(t, "False", r.URL.Query().Get("show-entries"))
+		require.Equal(t, "True", r.URL.Query().Get("show-summary"))
+		fmt.Fprint(w, `{
+			"entries": [],
+			"summary": [
+				{"user": "alice", "categories": [{"category": "get_obj", "ops": 3}], "total": {"ops": 3, "successful_ops": 2, "bytes_sent": 10, "bytes_received": 5}},
+				{"user": "bob", "categories": [], "total": {"ops": 0}}
+			]
+		}`)
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	entries := []usageSummaryEntry{}
+	err := getCephUsageSummary(context.Background(), client, rgwURL, signer, func(entry usageSummaryEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "alice", entries[0].User)
+	require.Equal(t, usageCategoryEntry{Ops: 3, SuccessfulOps: 2, BytesSent: 10, BytesReceived: 5}, entries[0].Total)
+	require.Equal(t, "bob", entries[1].User)
+}
@@ -0,0 +1,906 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/xhit/go-str2duration"
+)
+
+const (
+	viperLogLevel  = "log_level"
+	viperPort      = "port"
+	viperRGWURL    = "rgw_url"
+	viperInterval  = "interval"
+	viperAccessKey = "access_key"
+	viperSecretKey = "secret_key"
+
+	viperAccessKeyFile = "access_key_file"
+	viperSecretKeyFile = "secret_key_file"
+
+	viperCredentialsType            = "credentials.type"
+	viperCredentialsCommand         = "credentials.command"
+	viperCredentialsCommandTimeout  = "credentials.command_timeout"
+	viperCredentialsRefreshInterval = "credentials.refresh_interval"
+	viperCredentialsExpiryWindow    = "credentials.expiry_window"
+	viperVaultAddress               = "credentials.vault.address"
+	viperVaultPath                  = "credentials.vault.path"
+	viperVaultToken                 = "credentials.vault.token"
+	viperVaultTokenFile             = "credentials.vault.token_file"
+	viperVaultCAFile                = "credentials.vault.ca_file"
+	viperVaultAccessKeyField        = "credentials.vault.access_key_field"
+	viperVaultSecretKeyField        = "credentials.vault.secret_key_field"
+
+	viperTLSCAFile             = "tls.ca_file"
+	viperTLSCertFile           = "tls.cert_file"
+	viperTLSKeyFile            = "tls.key_file"
+	viperTLSServerName         = "tls.server_name"
+	viperTLSInsecureSkipVerify = "tls.insecure_skip_verify"
+
+	viperSigningRegion    = "signing_region"
+	viperSignatureVersion = "signature_version"
+
+	viperRequestTimeout = "request_timeout"
+	viperScrapeTimeout  = "scrape_timeout"
+	viperMaxStaleness   = "max_staleness"
+
+	viperReadinessRequireScrapes = "readiness.require_scrapes"
+	viperReadinessMaxScrapeAge   = "readiness.max_scrape_age"
+	viperSyncUserStats           = "sync_user_stats"
+	viperUserConcurrency         = "user_concurrency"
+	viperPageSize                = "page_size"
+	viperConfigFile              = "config_file"
+	viperWebConfigFile           = "web_config_file"
+
+	viperRetryMaxAttempts = "retry.max_attempts"
+	viperRetryBackoffBase = "retry.backoff_base"
+	viperRetryBackoffCap  = "retry.backoff_cap"
+	viperRetryJitter      = "retry.jitter"
+	viperRetryStatusCodes = "retry.status_codes"
+
+	viperOpsEnabled     = "collectors.ops.enabled"
+	viperBucketsEnabled = "collectors.buckets.enabled"
+	viperUsersEnabled   = "collectors.users.enabled"
+
+	viperOpsMode         = "collectors.ops.mode"
+	viperBucketsMode     = "collectors.buckets.mode"
+	viperUsersMode       = "collectors.users.mode"
+	viperOpsCacheTTL     = "collectors.ops.cache_ttl"
+	viperBucketsCacheTTL = "collectors.buckets.cache_ttl"
+	viperUsersCacheTTL   = "collectors.users.cache_ttl"
+
+	viperOpsInterval     = "collectors.ops.interval"
+	viperBucketsInterval = "collectors.buckets.interval"
+	viperUsersInterval   = "collectors.users.interval"
+	viperStartupJitter   = "startup_jitter"
+	viperOpsIncremental  = "collectors.ops.incremental"
+	viperOpsHourly       = "collectors.ops.hourly"
+	viperOpsSummary      = "collectors.ops.summary"
+	viperStateDir        = "state_dir"
+	viperStateRetention  = "state_retention"
+
+	viperBucketsInclude = "filters.buckets.include"
+	viperBucketsExclude = "filters.buckets.exclude"
+	viperUsersInclude   = "filters.users.include"
+	viperUsersExclude   = "filters.users.exclude"
+
+	viperLabels  = "labels"
+	viperTargets = "targets"
+	viperModules = "modules"
+)
+
+// knownConfigKeys are all the keys that can be set in the config file
+// `labels` and `modules` are maps, so any key below them is known too. The keys of the targets and modules are checked when they are decoded
+var knownConfigKeys = []string{
+	viperLogLevel, viperPort, viperRGWURL, viperInterval, viperAccessKey, viperSecretKey, viperAccessKeyFile, viperSecretKeyFile,
+	viperCredentialsType, viperCredentialsCommand, viperCredentialsCommandTimeout, viperCredentialsRefreshInterval, viperCredentialsExpiryWindow,
+	viperVaultAddress, viperVaultPath, viperVaultToken, viperVaultTokenFile, viperVaultCAFile, viperVaultAccessKeyField, viperVaultSecretKeyField,
+	viperTLSCAFile, viperTLSCertFile, viperTLSKeyFile, viperTLSServerName, viperTLSInsecureSkipVerify,
+	viperSigningRegion, viperSignatureVersion,
+	viperRequestTimeout, viperScrapeTimeout, viperMaxStaleness,
+	viperReadinessRequireScrapes, viperReadinessMaxScrapeAge, viperSyncUserStats, viperUserConcurrency, viperPageSize, viperConfigFile, viperWebConfigFile,
+	viperRetryMaxAttempts, viperRetryBackoffBase, viperRetryBackoffCap, viperRetryJitter, viperRetryStatusCodes,
+	viperOpsEnabled, viperBucketsEnabled, viperUsersEnabled, viperOpsMode, viperBucketsMode, viperUsersMode,
+	viperOpsCacheTTL, viperBucketsCacheTTL, viperUsersCacheTTL, viperOpsInterval, viperBucketsInterval, viperUsersInterval,
+	viperStartupJitter, viperOpsIncremental, viperOpsHourly, viperOpsSummary, viperStateDir, viperStateRetention,
+	viperBucketsInclude, viperBucketsExclude, viperUsersInclude, viperUsersExclude,
+	viperLabels, viperTargets, viperModules,
+}
+
+// strictDecoding makes decoding the targets and modules fail on unknown keys, instead of silently ignoring them
+func strictDecoding(config *mapstructure.DecoderConfig) {
+	config.ErrorUnused = true
+}
+
+// clusterLabel is added to the metrics of each named target
+const clusterLabel = "cluster"
+
+// newViper initializes viper with the defaults, the command line flags, the ENV variables, and the config file, if any
+// The precedence is flags, then ENV variables, then the config file, then the defaults
+func newViper(args []string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetEnvPrefix("RGW_EXPORTER")
+	// Nested keys are read from ENV with underscores. IE, `collectors.ops.enabled` is read from RGW_EXPORTER_COLLECTORS_OPS_ENABLED
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	// Initialize the input defaults
+	v.SetDefault(viperLogLevel, logrus.InfoLevel.String())
+	v.SetDefault(viperPort, 8080)
+	v.SetDefault(viperRGWURL, "")
+	v.SetDefault(viperInterval, "1m")
+	v.SetDefault(viperAccessKey, "")
+	v.SetDefault(viperSecretKey, "")
+	v.SetDefault(viperAccessKeyFile, "")
+	v.SetDefault(viperSecretKeyFile, "")
+	v.SetDefault(viperCredentialsType, credentialsStatic)
+	v.SetDefault(viperTLSInsecureSkipVerify, false)
+	v.SetDefault(viperSigningRegion, defaultSigningRegion)
+	v.SetDefault(viperSignatureVersion, signatureV4)
+	v.SetDefault(viperRequestTimeout, "")
+	v.SetDefault(viperScrapeTimeout, "")
+	v.SetDefault(viperMaxStaleness, "")
+	v.SetDefault(viperReadinessRequireScrapes, false)
+	v.SetDefault(viperReadinessMaxScrapeAge, "")
+	v.SetDefault(viperSyncUserStats, false)
+	v.SetDefault(viperUserConcurrency, 4)
+	v.SetDefault(viperPageSize, 0)
+	v.SetDefault(viperConfigFile, "")
+	v.SetDefault(viperWebConfigFile, "")
+	v.SetDefault(viperRetryMaxAttempts, 3)
+	v.SetDefault(viperRetryBackoffBase, "500ms")
+	v.SetDefault(viperRetryBackoffCap, "10s")
+	v.SetDefault(viperRetryJitter, 0.5)
+	v.SetDefault(viperRetryStatusCodes, []string{"429", "502", "503", "504"})
+	v.SetDefault(viperOpsEnabled, true)
+	v.SetDefault(viperBucketsEnabled, true)
+	v.SetDefault(viperUsersEnabled, true)
+	v.SetDefault(viperOpsMode, collectorModeInterval)
+	v.SetDefault(viperBucketsMode, collectorModeInterval)
+	v.SetDefault(viperUsersMode, collectorModeInterval)
+	v.SetDefault(viperOpsCacheTTL, "15s")
+	v.SetDefault(viperBucketsCacheTTL, "15s")
+	v.SetDefault(viperUsersCacheTTL, "15s")
+	v.SetDefault(viperOpsInterval, "")
+	v.SetDefault(viperBucketsInterval, "")
+	v.SetDefault(viperUsersInterval, "")
+	v.SetDefault(viperStartupJitter, "10s")
+	v.SetDefault(viperOpsIncremental, false)
+	v.SetDefault(viperOpsHourly, false)
+	v.SetDefault(viperOpsSummary, false)
+	v.SetDefault(viperStateDir, "")
+	v.SetDefault(viperStateRetention, "30d")
+	v.SetDefault(viperBucketsInclude, []string{})
+	v.SetDefault(viperBucketsExclude, []string{})
+	v.SetDefault(viperUsersInclude, []string{})
+	v.SetDefault(viperUsersExclude, []string{})
+
+	// Read the command line flags
+	flags := pflag.NewFlagSet("rgw-exporter", pflag.ContinueOnError)
+	flags.String("config", "", "Path to a YAML config file. ENV variables take precedence over the values in the file")
+	flags.String("web.config.file", "", "Path to a Prometheus exporter-toolkit web config file, which can enable TLS and basic auth on the server")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := v.BindPFlag(viperConfigFile, flags.Lookup("config")); err != nil {
+		return nil, fmt.Errorf("failed to bind the config flag - %w", err)
+	}
+	if err := v.BindPFlag(viperWebConfigFile, flags.Lookup("web.config.file")); err != nil {
+		return nil, fmt.Errorf("failed to bind the web.config.file flag - %w", err)
+	}
+
+	// Read them from ENV
+	v.AutomaticEnv()
+
+	// The collector settings can also be set without the COLLECTORS_ part. IE, RGW_EXPORTER_BUCKETS_INTERVAL
+	for _, key := range []string{
+		viperOpsEnabled, viperBucketsEnabled, viperUsersEnabled, viperOpsMode, viperBucketsMode, viperUsersMode,
+		viperOpsCacheTTL, viperBucketsCacheTTL, viperUsersCacheTTL, viperOpsInterval, viperBucketsInterval, viperUsersInterval,
+		viperOpsIncremental, viperOpsHourly, viperOpsSummary,
+	} {
+		if err := v.BindEnv(key, collectorEnvName(key)); err != nil {
+			return nil, fmt.Errorf("failed to bind ENV variable of `%s` - %w", key, err)
+		}
+	}
+
+	// Optionally read a config file. This is required for the structured settings, like multiple targets
+	if configFile := v.GetString(viperConfigFile); configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file `%s` - %w", configFile, err)
+		}
+	}
+
+	return v, nil
+}
+
+// exporterConfig is the validated configuration of the whole exporter
+type exporterConfig struct {
+	logLevel logrus.Level
+	port     int
+	// webConfigFile enables TLS and basic auth on the server. It is read again for each new connection, so certificates can be rotated
+	webConfigFile string
+	readiness     readinessConfig
+	targets       []*rgwTarget
+	modules       map[string]*probeModule
+	// secretFiles are the files the secrets were read from
+	secretFiles []string
+}
+
+// checkUnknownKeys returns an error if the config file has keys that aren't settings
+// Viper would silently ignore them. IE, `collectors_ops_enabled` instead of the nested `collectors: {ops: {enabled: ...}}`
+func checkUnknownKeys(v *viper.Viper) error {
+	known := map[string]bool{}
+	for _, key := range knownConfigKeys {
+		known[key] = true
+	}
+
+	unknown := []string{}
+	for _, key := range v.AllKeys() {
+		if known[key] || strings.HasPrefix(key, viperLabels+".") || strings.HasPrefix(key, viperModules+".") {
+			continue
+		}
+
+		unknown = append(unknown, key)
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config keys [%s]. Grouped settings must be nested in the config file. IE, `collectors.ops.enabled` is `collectors: {ops: {enabled: ...}}`", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// loadConfig validates the configuration read by viper
+func loadConfig(v *viper.Viper) (*exporterConfig, error) {
+	if err := checkUnknownKeys(v); err != nil {
+		return nil, err
+	}
+
+	logLevelStr := v.GetString(viperLogLevel)
+	logLevel, err := logrus.ParseLevel(logLevelStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RGW_EXPORTER_LOG_LEVEL `%s` - %w", logLevelStr, err)
+	}
+
+	// The request timeout is optional. An empty value means requests are only limited by the scrape timeout
+	// Bucket stats and usage log requests can take minutes on large clusters, so there is no default limit
+	var requestTimeout time.Duration
+	if requestTimeoutStr := v.GetString(viperRequestTimeout); requestTimeoutStr != "" {
+		requestTimeout, err = str2duration.Str2Duration(requestTimeoutStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RGW_EXPORTER_REQUEST_TIMEOUT `%s` as a duration - %w", requestTimeoutStr, err)
+		}
+	}
+
+	// The scrape timeout is optional. An empty value means scrapes are only limited by the request timeout, if any
+	var scrapeTimeout time.Duration
+	if scrapeTimeoutStr := v.GetString(viperScrapeTimeout); scrapeTimeoutStr != "" {
+		scrapeTimeout, err = str2duration.Str2Duration(scrapeTimeoutStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RGW_EXPORTER_SCRAPE_TIMEOUT `%s` as a duration - %w", scrapeTimeoutStr, err)
+		}
+	}
+
+	// The max staleness is optional. An empty value means the metrics of the last successful scrape are always exported
+	var maxStaleness time.Duration
+	if maxStalenessStr := v.GetString(viperMaxStaleness); maxStalenessStr != "" {
+		maxStaleness, err = str2duration.Str2Duration(maxStalenessStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RGW_EXPORTER_MAX_STALENESS `%s` as a duration - %w", maxStalenessStr, err)
+		}
+	}
+
+	readiness := readinessConfig{
+		RequireScrapes: v.GetBool(viperReadinessRequireScrapes),
+	}
+	if maxScrapeAgeStr := v.GetString(viperReadinessMaxScrapeAge); maxScrapeAgeStr != "" {
+		readiness.MaxScrapeAge, err = str2duration.Str2Duration(maxScrapeAgeStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RGW_EXPORTER_READINESS_MAX_SCRAPE_AGE `%s` as a duration - %w", maxScrapeAgeStr, err)
+		}
+	}
+
+	userConcurrency := v.GetInt(viperUserConcurrency)
+	if userConcurrency < 1 {
+		return nil, fmt.Errorf("RGW_EXPORTER_USER_CONCURRENCY must be at least 1, got %d", userConcurrency)
+	}
+
+	pageSize := v.GetInt(viperPageSize)
+	if pageSize < 0 {
+		return nil, fmt.Errorf("RGW_EXPORTER_PAGE_SIZE must not be negative, got %d", pageSize)
+	}
+
+	retryOpts, err := loadRetryOptions(v)
+	if err != nil {
+		return nil, err
+	}
+
+	opsOpts, err := loadCollectorOptions(v, viperOpsEnabled, viperOpsMode, viperOpsCacheTTL, viperOpsInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	opsOpts.Incremental = v.GetBool(viperOpsIncremental)
+	opsOpts.Hourly = v.GetBool(viperOpsHourly)
+	opsOpts.Summary = v.GetBool(viperOpsSummary)
+	if opsOpts.Summary && (opsOpts.Incremental || opsOpts.Hourly) {
+		return nil, fmt.Errorf("RGW_EXPORTER_OPS_SUMMARY can't be combined with RGW_EXPORTER_OPS_INCREMENTAL or RGW_EXPORTER_OPS_HOURLY, which need the usage of each bucket")
+	}
+
+	stateDir := v.GetString(viperStateDir)
+	if stateDir != "" {
+		info, err := os.Stat(stateDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RGW_EXPORTER_STATE_DIR `%s` - %w", stateDir, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("RGW_EXPORTER_STATE_DIR `%s` is not a directory", stateDir)
+		}
+	}
+
+	stateRetentionStr := v.GetString(viperStateRetention)
+	stateRetention, err := str2duration.Str2Duration(stateRetentionStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RGW_EXPORTER_STATE_RETENTION `%s` as a duration - %w", stateRetentionStr, err)
+	}
+
+	bucketsOpts, err := loadCollectorOptions(v, viperBucketsEnabled, viperBucketsMode, viperBucketsCacheTTL, viperBucketsInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	usersOpts, err := loadCollectorOptions(v, viperUsersEnabled, viperUsersMode, viperUsersCacheTTL, viperUsersInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	startupJitterStr := v.GetString(viperStartupJitter)
+	startupJitter, err := str2duration.Str2Duration(startupJitterStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RGW_EXPORTER_STARTUP_JITTER `%s` as a duration - %w", startupJitterStr, err)
+	}
+
+	bucketFilter, err := NewNameFilter(v.GetStringSlice(viperBucketsInclude), v.GetStringSlice(viperBucketsExclude))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket filter - %w", err)
+	}
+
+	userFilter, err := NewNameFilter(v.GetStringSlice(viperUsersInclude), v.GetStringSlice(viperUsersExclude))
+	if err != nil {
+		return nil, fmt.Errorf("invalid user filter - %w", err)
+	}
+
+	scrapeOpts := ScrapeOptions{
+		Timeout:         scrapeTimeout,
+		MaxStaleness:    maxStaleness,
+		StateRetention:  stateRetention,
+		StartupJitter:   startupJitter,
+		SyncUserStats:   v.GetBool(viperSyncUserStats),
+		UserConcurrency: userConcurrency,
+		PageSize:        pageSize,
+		Retry:           retryOpts,
+
+		Ops:     opsOpts,
+		Buckets: bucketsOpts,
+		Users:   usersOpts,
+
+		BucketFilter: bucketFilter,
+		UserFilter:   userFilter,
+	}
+
+	labels, err := validateLabels(v.GetStringMapString(viperLabels), viperLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	// The top level credentials are used by the targets and modules that don't set their own
+	secrets := &secretReader{}
+	accessKey, err := secrets.read("RGW_EXPORTER_ACCESS_KEY", v.GetString(viperAccessKey), "RGW_EXPORTER_ACCESS_KEY_FILE", v.GetString(viperAccessKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	secretKey, err := secrets.read("RGW_EXPORTER_SECRET_KEY", v.GetString(viperSecretKey), "RGW_EXPORTER_SECRET_KEY_FILE", v.GetString(viperSecretKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	credsConfig := &credentialsConfig{
+		Type:            v.GetString(viperCredentialsType),
+		Command:         v.GetString(viperCredentialsCommand),
+		CommandTimeout:  v.GetString(viperCredentialsCommandTimeout),
+		RefreshInterval: v.GetString(viperCredentialsRefreshInterval),
+		ExpiryWindow:    v.GetString(viperCredentialsExpiryWindow),
+		Vault: vaultConfig{
+			Address:        v.GetString(viperVaultAddress),
+			Path:           v.GetString(viperVaultPath),
+			Token:          v.GetString(viperVaultToken),
+			TokenFile:      v.GetString(viperVaultTokenFile),
+			CAFile:         v.GetString(viperVaultCAFile),
+			AccessKeyField: v.GetString(viperVaultAccessKeyField),
+			SecretKeyField: v.GetString(viperVaultSecretKeyField),
+		},
+	}
+
+	tlsCfg := &tlsConfig{
+		CAFile:             v.GetString(viperTLSCAFile),
+		CertFile:           v.GetString(viperTLSCertFile),
+		KeyFile:            v.GetString(viperTLSKeyFile),
+		ServerName:         v.GetString(viperTLSServerName),
+		InsecureSkipVerify: v.GetBool(viperTLSInsecureSkipVerify),
+	}
+
+	signing := signingConfig{
+		SigningRegion:    v.GetString(viperSigningRegion),
+		SignatureVersion: v.GetString(viperSignatureVersion),
+	}
+
+	targetConfigs, err := loadTargetConfigs(v, accessKey, secretKey, credsConfig, tlsCfg, signing)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []*rgwTarget{}
+	for _, targetConfig := range targetConfigs {
+		target, err := newRGWTarget(targetConfig, labels, secrets, requestTimeout, scrapeOpts)
+		if err != nil {
+			return nil, err
+		}
+		target.opts.UsageStateFile = usageStatePath(stateDir, target.name)
+
+		targets = append(targets, target)
+	}
+
+	modules, err := loadProbeModules(v, labels, accessKey, secretKey, credsConfig, tlsCfg, signing, secrets, requestTimeout, scrapeOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	webConfigFile := v.GetString(viperWebConfigFile)
+	if err := web.Validate(webConfigFile); err != nil {
+		return nil, fmt.Errorf("invalid RGW_EXPORTER_WEB_CONFIG_FILE `%s` - %w", webConfigFile, err)
+	}
+
+	return &exporterConfig{
+		logLevel:      logLevel,
+		port:          v.GetInt(viperPort),
+		webConfigFile: webConfigFile,
+		readiness:     readiness,
+		targets:       targets,
+		modules:       modules,
+
+		secretFiles: secrets.files,
+	}, nil
+}
+
+// loadCollectorOptions validates the options of a single collector, read from the given keys
+func loadCollectorOptions(v *viper.Viper, enabledKey string, modeKey string, cacheTTLKey string, intervalKey string) (CollectorOptions, error) {
+	opts := CollectorOptions{
+		Enabled: v.GetBool(enabledKey),
+	}
+
+	switch mode := v.GetString(modeKey); mode {
+	case collectorModeInterval:
+	case collectorModeOnDemand:
+		opts.OnDemand = true
+	default:
+		return CollectorOptions{}, fmt.Errorf("%s `%s` is not one of [%s, %s]", collectorEnvName(modeKey), mode, collectorModeInterval, collectorModeOnDemand)
+	}
+
+	cacheTTLStr := v.GetString(cacheTTLKey)
+	cacheTTL, err := str2duration.Str2Duration(cacheTTLStr)
+	if err != nil {
+		return CollectorOptions{}, fmt.Errorf("failed to parse %s `%s` as a duration - %w", collectorEnvName(cacheTTLKey), cacheTTLStr, err)
+	}
+	opts.CacheTTL = cacheTTL
+
+	// An empty interval means the collector uses the interval of the target
+	if intervalStr := v.GetString(intervalKey); intervalStr != "" {
+		opts.Interval, err = str2duration.Str2Duration(intervalStr)
+		if err != nil {
+			return CollectorOptions{}, fmt.Errorf("failed to parse %s `%s` as a duration - %w", collectorEnvName(intervalKey), intervalStr, err)
+		}
+		if opts.Interval <= 0 {
+			return CollectorOptions{}, fmt.Errorf("%s must be positive, got `%s`", collectorEnvName(intervalKey), intervalStr)
+		}
+	}
+
+	return opts, nil
+}
+
+// envName returns the ENV variable of the viper `key`
+func envName(key string) string {
+	return "RGW_EXPORTER_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// collectorEnvName returns the short ENV variable of the collector setting `key`, without the COLLECTORS_ part
+func collectorEnvName(key string) string {
+	return envName(strings.TrimPrefix(key, "collectors."))
+}
+
+// loadRetryOptions validates the retry policy of the admin API requests
+func loadRetryOptions(v *viper.Viper) (RetryOptions, error) {
+	opts := RetryOptions{
+		MaxAttempts: v.GetInt(viperRetryMaxAttempts),
+		Jitter:      v.GetFloat64(viperRetryJitter),
+	}
+	if opts.MaxAttempts < 1 {
+		return RetryOptions{}, fmt.Errorf("RGW_EXPORTER_RETRY_MAX_ATTEMPTS must be at least 1, got %d", opts.MaxAttempts)
+	}
+	if opts.Jitter < 0 || opts.Jitter > 1 {
+		return RetryOptions{}, fmt.Errorf("RGW_EXPORTER_RETRY_JITTER must be between 0 and 1, got %v", opts.Jitter)
+	}
+
+	var err error
+	backoffBaseStr := v.GetString(viperRetryBackoffBase)
+	opts.BackoffBase, err = str2duration.Str2Duration(backoffBaseStr)
+	if err != nil {
+		return RetryOptions{}, fmt.Errorf("failed to parse RGW_EXPORTER_RETRY_BACKOFF_BASE `%s` as a duration - %w", backoffBaseStr, err)
+	}
+
+	backoffCapStr := v.GetString(viperRetryBackoffCap)
+	opts.BackoffCap, err = str2duration.Str2Duration(backoffCapStr)
+	if err != nil {
+		return RetryOptions{}, fmt.Errorf("failed to parse RGW_EXPORTER_RETRY_BACKOFF_CAP `%s` as a duration - %w", backoffCapStr, err)
+	}
+	if opts.BackoffCap < opts.BackoffBase {
+		return RetryOptions{}, fmt.Errorf("RGW_EXPORTER_RETRY_BACKOFF_CAP `%s` must not be less than RGW_EXPORTER_RETRY_BACKOFF_BASE `%s`", backoffCapStr, backoffBaseStr)
+	}
+
+	for _, codeStr := range v.GetStringSlice(viperRetryStatusCodes) {
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || code < 100 || code > 599 {
+			return RetryOptions{}, fmt.Errorf("RGW_EXPORTER_RETRY_STATUS_CODES has an invalid status code `%s`", codeStr)
+		}
+
+		opts.StatusCodes = append(opts.StatusCodes, code)
+	}
+
+	return opts, nil
+}
+
+// validateLabels checks that `labels` can be added to the exported metrics
+func validateLabels(labels map[string]string, field string) (prometheus.Labels, error) {
+	validated := prometheus.Labels{}
+	for name, value := range labels {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("%s has an invalid label name `%s`", field, name)
+		}
+		if name == clusterLabel {
+			return nil, fmt.Errorf("%s can't set the `%s` label. It is set from the target name", field, clusterLabel)
+		}
+
+		validated[name] = value
+	}
+
+	return validated, nil
+}
+
+// targetConfig is the configuration of a single RGW instance to scrape, as given by the user
+// The keys match the equivalent ENV variables, without the RGW_EXPORTER_ prefix
+type targetConfig struct {
+	Name          string            `mapstructure:"name"`
+	RGWURL        string            `mapstructure:"rgw_url"`
+	AccessKey     string            `mapstructure:"access_key"`
+	SecretKey     string            `mapstructure:"secret_key"`
+	AccessKeyFile string            `mapstructure:"access_key_file"`
+	SecretKeyFile string            `mapstructure:"secret_key_file"`
+	Interval      string            `mapstructure:"interval"`
+	Labels        map[string]string `mapstructure:"labels"`
+
+	Credentials   *credentialsConfig `mapstructure:"credentials"`
+	TLS           *tlsConfig         `mapstructure:"tls"`
+	signingConfig `mapstructure:",squash"`
+
+	// fieldPrefix is used to tell the user where an invalid value came from
+	fieldPrefix string
+}
+
+func (c targetConfig) field(key string) string {
+	if c.fieldPrefix == "RGW_EXPORTER_" {
+		return c.fieldPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+	}
+
+	return c.fieldPrefix + key
+}
+
+// hasKeys returns true if the target sets its own static credentials
+func (c targetConfig) hasKeys() bool {
+	return c.AccessKey != "" || c.AccessKeyFile != "" || c.SecretKey != "" || c.SecretKeyFile != ""
+}
+
+// rgwTarget is a validated RGW instance to scrape
+type rgwTarget struct {
+	// name is added as the `cluster` label to all the metrics of the target. It is empty if only a single target is configured via ENV
+	name string
+	// labels are added to all the metrics of the target
+	labels prometheus.Labels
+	client *http.Client
+	rgwURL *url.URL
+	signer *requestSigner
+	opts   ScrapeOptions
+}
+
+// loadTargetConfigs returns the configs of the RGW instances to scrape
+// If the config file has a `targets` list, those are used. Otherwise a single, unnamed, target is configured from the ENV variables
+// An exporter that only serves /probe requests doesn't need any targets
+// `accessKey`, `secretKey`, and `creds` are the top level credentials, which are used by the targets that don't set their own. Same for `tlsCfg` and `signing`
+func loadTargetConfigs(v *viper.Viper, accessKey string, secretKey string, creds *credentialsConfig, tlsCfg *tlsConfig, signing signingConfig) ([]targetConfig, error) {
+	if !v.IsSet(viperTargets) && v.GetString(viperRGWURL) == "" && v.IsSet(viperModules) {
+		return []targetConfig{}, nil
+	}
+
+	if !v.IsSet(viperTargets) {
+		return []targetConfig{
+			{
+				RGWURL:    v.GetString(viperRGWURL),
+				AccessKey: accessKey,
+				SecretKey: secretKey,
+				Interval:  v.GetString(viperInterval),
+
+				Credentials:   creds,
+				TLS:           tlsCfg,
+				signingConfig: signing,
+
+				fieldPrefix: "RGW_EXPORTER_",
+			},
+		}, nil
+	}
+
+	configs := []targetConfig{}
+	if err := v.UnmarshalKey(viperTargets, &configs, strictDecoding); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s` - %w", viperTargets, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("`%s` must contain at least one target", viperTargets)
+	}
+
+	names := map[string]bool{}
+	for i := range configs {
+		configs[i].fieldPrefix = fmt.Sprintf("%s[%d].", viperTargets, i)
+
+		// Targets inherit the credentials and interval from the top level config if they don't set their own
+		if configs[i].Credentials == nil && !configs[i].hasKeys() {
+			configs[i].Credentials = creds
+		}
+		if configs[i].AccessKey == "" && configs[i].AccessKeyFile == "" {
+			configs[i].AccessKey = accessKey
+		}
+		if configs[i].SecretKey == "" && configs[i].SecretKeyFile == "" {
+			configs[i].SecretKey = secretKey
+		}
+		if configs[i].Interval == "" {
+			configs[i].Interval = v.GetString(viperInterval)
+		}
+		if configs[i].TLS == nil {
+			configs[i].TLS = tlsCfg
+		}
+		configs[i].signingConfig = configs[i].signingConfig.inherit(signing)
+
+		// The name becomes the `cluster` label, so it must tell the targets apart
+		name := configs[i].Name
+		if name == "" && len(configs) > 1 {
+			return nil, fmt.Errorf("%s is required when scraping multiple targets", configs[i].field("name"))
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%s `%s` is used by more than one target", configs[i].field("name"), name)
+		}
+		names[name] = true
+	}
+
+	return configs, nil
+}
+
+// newRGWTarget validates cfg and creates the client and credentials used to scrape it
+// The target's labels are added on top of `commonLabels`
+func newRGWTarget(cfg targetConfig, commonLabels prometheus.Labels, secrets *secretReader, requestTimeout time.Duration, opts ScrapeOptions) (*rgwTarget, error) {
+	if cfg.RGWURL == "" {
+		return nil, fmt.Errorf("%s is a required argument", cfg.field("rgw_url"))
+	}
+
+	rgwURL, err := url.Parse(cfg.RGWURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s `%s` - %w", cfg.field("rgw_url"), cfg.RGWURL, err)
+	}
+
+	if cfg.Interval == "" {
+		return nil, fmt.Errorf("%s is a required argument", cfg.field("interval"))
+	}
+
+	opts.Interval, err = str2duration.Str2Duration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s `%s` as a duration - %w", cfg.field("interval"), cfg.Interval, err)
+	}
+
+	creds, err := loadCredentials(cfg.field, cfg.Credentials, cfg.AccessKey, cfg.AccessKeyFile, cfg.SecretKey, cfg.SecretKeyFile, secrets, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := cfg.signingConfig.newSigner(cfg.field, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.TLS, func(key string) string { return cfg.field("tls." + key) }, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	targetLabels, err := validateLabels(cfg.Labels, cfg.field("labels"))
+	if err != nil {
+		return nil, err
+	}
+
+	labels := prometheus.Labels{}
+	for name, value := range commonLabels {
+		labels[name] = value
+	}
+	for name, value := range targetLabels {
+		labels[name] = value
+	}
+	if cfg.Name != "" {
+		labels[clusterLabel] = cfg.Name
+	}
+
+	return &rgwTarget{
+		name:   cfg.Name,
+		labels: labels,
+		client: makeHTTPClient(requestTimeout, tlsConfig),
+		rgwURL: rgwURL,
+		signer: signer,
+		opts:   opts,
+	}, nil
+}
+
+// moduleConfig is the configuration used to scrape the RGW instances given to the /probe endpoint
+type moduleConfig struct {
+	AccessKey     string `mapstructure:"access_key"`
+	SecretKey     string `mapstructure:"secret_key"`
+	AccessKeyFile string `mapstructure:"access_key_file"`
+	SecretKeyFile string `mapstructure:"secret_key_file"`
+	// Targets are the URLs of the RGW instances the module can probe
+	Targets []string `mapstructure:"targets"`
+
+	Credentials   *credentialsConfig `mapstructure:"credentials"`
+	TLS           *tlsConfig         `mapstructure:"tls"`
+	signingConfig `mapstructure:",squash"`
+}
+
+// hasKeys returns true if the module sets its own static credentials
+func (c moduleConfig) hasKeys() bool {
+	return c.AccessKey != "" || c.AccessKeyFile != "" || c.SecretKey != "" || c.SecretKeyFile != ""
+}
+
+// probeModule is a validated moduleConfig
+type probeModule struct {
+	// labels are added to all the metrics of the probe
+	labels prometheus.Labels
+	// targets are the RGW instances the module can probe. The requests are signed with the module's credentials, so they
+	// must not be sent anywhere else
+	targets []*url.URL
+	client  *http.Client
+	signer  *requestSigner
+	opts    ScrapeOptions
+}
+
+// allows returns true if the module can probe `rgwURL`
+func (m *probeModule) allows(rgwURL *url.URL) bool {
+	for _, target := range m.targets {
+		if target.Scheme == rgwURL.Scheme && strings.EqualFold(target.Host, rgwURL.Host) && strings.TrimSuffix(target.Path, "/") == strings.TrimSuffix(rgwURL.Path, "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadProbeModules returns the modules that can be used by the /probe endpoint, keyed by name
+// `accessKey`, `secretKey`, and `creds` are the top level credentials, which are used by the modules that don't set their own. Same for `tlsCfg` and `signing`
+func loadProbeModules(v *viper.Viper, labels prometheus.Labels, accessKey string, secretKey string, creds *credentialsConfig, tlsCfg *tlsConfig, signing signingConfig, secrets *secretReader, requestTimeout time.Duration, opts ScrapeOptions) (map[string]*probeModule, error) {
+	configs := map[string]moduleConfig{}
+	if err := v.UnmarshalKey(viperModules, &configs, strictDecoding); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s` - %w", viperModules, err)
+	}
+
+	modules := map[string]*probeModule{}
+	for name, cfg := range configs {
+		// Modules inherit the credentials from the top level config if they don't set their own
+		if cfg.Credentials == nil && !cfg.hasKeys() {
+			cfg.Credentials = creds
+		}
+		if cfg.AccessKey == "" && cfg.AccessKeyFile == "" {
+			cfg.AccessKey = accessKey
+		}
+		if cfg.SecretKey == "" && cfg.SecretKeyFile == "" {
+			cfg.SecretKey = secretKey
+		}
+		if cfg.TLS == nil {
+			cfg.TLS = tlsCfg
+		}
+		cfg.signingConfig = cfg.signingConfig.inherit(signing)
+
+		prefix := fmt.Sprintf("%s.%s.", viperModules, name)
+		field := func(key string) string { return prefix + key }
+
+		if len(cfg.Targets) == 0 {
+			return nil, fmt.Errorf("%s is required. The module's credentials are only sent to the listed RGW instances", field("targets"))
+		}
+
+		targets := make([]*url.URL, 0, len(cfg.Targets))
+		for _, target := range cfg.Targets {
+			targetURL, err := parseProbeTarget(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s - %w", field("targets"), err)
+			}
+
+			targets = append(targets, targetURL)
+		}
+
+		moduleCreds, err := loadCredentials(field, cfg.Credentials, cfg.AccessKey, cfg.AccessKeyFile, cfg.SecretKey, cfg.SecretKeyFile, secrets, requestTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		moduleSigner, err := cfg.signingConfig.newSigner(field, moduleCreds)
+		if err != nil {
+			return nil, err
+		}
+
+		moduleTLSConfig, err := newTLSConfig(cfg.TLS, func(key string) string { return field("tls." + key) }, secrets)
+		if err != nil {
+			return nil, err
+		}
+
+		modules[name] = &probeModule{
+			labels:  labels,
+			targets: targets,
+			client:  makeHTTPClient(requestTimeout, moduleTLSConfig),
+			signer:  moduleSigner,
+			opts:    opts,
+		}
+	}
+
+	return modules, nil
+}
+
+// loadCredentials creates the credentials of a target or module
+// Static credentials are read from the access / secret key settings. Other types are created from `cfg`
+func loadCredentials(field func(key string) string, cfg *credentialsConfig, accessKey string, accessKeyFile string, secretKey string, secretKeyFile string, secrets *secretReader, requestTimeout time.Duration) (*credentials.Credentials, error) {
+	if !cfg.isStatic() {
+		return newCredentialsProvider(*cfg, func(key string) string { return field("credentials." + key) }, secrets, requestTimeout)
+	}
+
+	accessKey, err := secrets.read(field("access_key"), accessKey, field("access_key_file"), accessKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if accessKey == "" {
+		return nil, fmt.Errorf("%s or %s is a required argument", field("access_key"), field("access_key_file"))
+	}
+
+	secretKey, err = secrets.read(field("secret_key"), secretKey, field("secret_key_file"), secretKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if secretKey == "" {
+		return nil, fmt.Errorf("%s or %s is a required argument", field("secret_key"), field("secret_key_file"))
+	}
+
+	return credentials.NewStaticCredentials(accessKey, secretKey, ""), nil
+}
@@ -0,0 +1,361 @@
+package pkg
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	configFile := writeConfigFile(t, `
+access_key: access
+secret_key: secret
+signing_region: zg1
+labels:
+  env: prod
+  region: us-east
+collectors:
+  users:
+    enabled: false
+filters:
+  buckets:
+    exclude: ["tmp-.*"]
+targets:
+  - name: east
+    rgw_url: http://east.example.com/
+    labels:
+      region: us-west
+  - name: legacy
+    rgw_url: http://legacy.example.com/
+    signature_version: v2
+`)
+
+	// ENV takes precedence over the file
+	t.Setenv("RGW_EXPORTER_COLLECTORS_OPS_ENABLED", "false")
+
+	v, err := newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+	require.Len(t, cfg.targets, 2)
+
+	target := cfg.targets[0]
+	require.Equal(t, prometheus.Labels{"cluster": "east", "env": "prod", "region": "us-west"}, target.labels)
+	require.False(t, target.opts.Ops.Enabled)
+	require.True(t, target.opts.Buckets.Enabled)
+	require.False(t, target.opts.Users.Enabled)
+	require.True(t, target.opts.BucketFilter.Keep("photos"))
+	require.False(t, target.opts.BucketFilter.Keep("tmp-photos"))
+	require.Nil(t, target.opts.UserFilter)
+	require.Equal(t, "zg1", target.signer.region)
+	require.Equal(t, signatureV4, target.signer.version)
+
+	// Requests aren't limited by default, since the bucket stats and usage log can take minutes
+	require.Zero(t, target.client.Timeout)
+
+	// Targets can override the signature settings
+	require.Equal(t, signatureV2, cfg.targets[1].signer.version)
+}
+
+func TestLoadConfigInvalidLabels(t *testing.T) {
+	for name, labels := range map[string]string{
+		"invalid name": "labels:\n  1abc: value\n",
+		"reserved":     "labels:\n  cluster: value\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			configFile := writeConfigFile(t, "rgw_url: http://example.com/\naccess_key: access\nsecret_key: secret\n"+labels)
+
+			v, err := newViper([]string{"--config", configFile})
+			require.NoError(t, err)
+
+			_, err = loadConfig(v)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	accessKeyFile := filepath.Join(dir, "access_key")
+	secretKeyFile := filepath.Join(dir, "secret_key")
+	require.NoError(t, os.WriteFile(accessKeyFile, []byte("access\n"), 0o600))
+	require.NoError(t, os.WriteFile(secretKeyFile, []byte("secret\n"), 0o600))
+
+	t.Setenv("RGW_EXPORTER_RGW_URL", "http://example.com/")
+	t.Setenv("RGW_EXPORTER_ACCESS_KEY_FILE", accessKeyFile)
+	t.Setenv("RGW_EXPORTER_SECRET_KEY_FILE", secretKeyFile)
+
+	v, err := newViper([]string{})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{accessKeyFile, secretKeyFile}, cfg.secretFiles)
+
+	creds, err := cfg.targets[0].signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access", creds.AccessKeyID)
+	require.Equal(t, "secret", creds.SecretAccessKey)
+
+	// The secret can't be given both ways
+	t.Setenv("RGW_EXPORTER_SECRET_KEY", "other-secret")
+
+	v, err = newViper([]string{})
+	require.NoError(t, err)
+
+	_, err = loadConfig(v)
+	require.Error(t, err)
+}
+
+func TestLoadConfigCollectorIntervals(t *testing.T) {
+	configFile := writeConfigFile(t, `
+rgw_url: http://example.com/
+access_key: access
+secret_key: secret
+interval: 5m
+collectors:
+  ops:
+    interval: 1h
+`)
+
+	t.Setenv("RGW_EXPORTER_BUCKETS_INTERVAL", "6h")
+	t.Setenv("RGW_EXPORTER_USERS_ENABLED", "false")
+
+	v, err := newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+
+	opts := cfg.targets[0].opts
+	require.Equal(t, time.Hour, opts.Ops.interval(opts.Interval))
+	require.Equal(t, 6*time.Hour, opts.Buckets.interval(opts.Interval))
+	require.Equal(t, 5*time.Minute, opts.Users.interval(opts.Interval))
+	require.False(t, opts.Users.Enabled)
+	require.Equal(t, 10*time.Second, opts.StartupJitter)
+
+	t.Setenv("RGW_EXPORTER_COLLECTORS_BUCKETS_INTERVAL", "0s")
+
+	v, err = newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	_, err = loadConfig(v)
+	require.Error(t, err)
+}
+
+func TestLoadConfigCollectorModes(t *testing.T) {
+	t.Setenv("RGW_EXPORTER_RGW_URL", "http://example.com/")
+	t.Setenv("RGW_EXPORTER_ACCESS_KEY", "access")
+	t.Setenv("RGW_EXPORTER_SECRET_KEY", "secret")
+
+	// The collector settings can be given with or without the COLLECTORS_ part
+	t.Setenv("RGW_EXPORTER_OPS_MODE", "on_demand")
+	t.Setenv("RGW_EXPORTER_BUCKETS_CACHE_TTL", "1m")
+	t.Setenv("RGW_EXPORTER_COLLECTORS_USERS_MODE", "on_demand")
+	t.Setenv("RGW_EXPORTER_COLLECTORS_USERS_CACHE_TTL", "2m")
+
+	v, err := newViper(nil)
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+
+	opts := cfg.targets[0].opts
+	require.True(t, opts.Ops.OnDemand)
+	require.Equal(t, 15*time.Second, opts.Ops.CacheTTL)
+	require.False(t, opts.Buckets.OnDemand)
+	require.Equal(t, time.Minute, opts.Buckets.CacheTTL)
+	require.True(t, opts.Users.OnDemand)
+	require.Equal(t, 2*time.Minute, opts.Users.CacheTTL)
+
+	// Errors name the short ENV variable
+	t.Setenv("RGW_EXPORTER_BUCKETS_MODE", "sometimes")
+
+	v, err = newViper(nil)
+	require.NoError(t, err)
+
+	_, err = loadConfig(v)
+	require.ErrorContains(t, err, "RGW_EXPORTER_BUCKETS_MODE")
+}
+
+func TestLoadConfigOpsSummary(t *testing.T) {
+	t.Setenv("RGW_EXPORTER_RGW_URL", "http://example.com/")
+	t.Setenv("RGW_EXPORTER_ACCESS_KEY", "access")
+	t.Setenv("RGW_EXPORTER_SECRET_KEY", "secret")
+	t.Setenv("RGW_EXPORTER_OPS_SUMMARY", "true")
+
+	v, err := newViper([]string{})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+	require.True(t, cfg.targets[0].opts.Ops.Summary)
+
+	// The summary has no per-bucket usage to query incrementally
+	t.Setenv("RGW_EXPORTER_OPS_INCREMENTAL", "true")
+
+	v, err = newViper([]string{})
+	require.NoError(t, err)
+
+	_, err = loadConfig(v)
+	require.Error(t, err)
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	load := func(contents string) error {
+		v, err := newViper([]string{"--config", writeConfigFile(t, contents)})
+		require.NoError(t, err)
+
+		_, err = loadConfig(v)
+		return err
+	}
+
+	// Nested settings are valid, and so are any labels and module names
+	require.NoError(t, load(`
+rgw_url: http://example.com/
+access_key: access
+secret_key: secret
+collectors:
+  ops:
+    enabled: false
+retry:
+  max_attempts: 2
+labels:
+  region: us-east
+`))
+
+	// The flat form of a nested setting would be silently ignored
+	err := load(`
+rgw_url: http://example.com/
+access_key: access
+secret_key: secret
+collectors_ops_enabled: false
+`)
+	require.ErrorContains(t, err, "collectors_ops_enabled")
+
+	// So would the unknown keys of a target
+	err = load(`
+access_key: access
+secret_key: secret
+targets:
+  - name: east
+    rgw_url: http://example.com/
+    intervl: 5m
+`)
+	require.ErrorContains(t, err, "intervl")
+}
+
+func TestLoadConfigTargetNames(t *testing.T) {
+	for name, targets := range map[string]string{
+		"missing":   "  - name: east\n    rgw_url: http://east.example.com/\n  - rgw_url: http://west.example.com/\n",
+		"duplicate": "  - name: east\n    rgw_url: http://east.example.com/\n  - name: east\n    rgw_url: http://west.example.com/\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			configFile := writeConfigFile(t, "access_key: access\nsecret_key: secret\ntargets:\n"+targets)
+
+			v, err := newViper([]string{"--config", configFile})
+			require.NoError(t, err)
+
+			_, err = loadConfig(v)
+			require.ErrorContains(t, err, "targets[1].name")
+		})
+	}
+
+	// A single target doesn't need a name, and doesn't get a `cluster` label
+	configFile := writeConfigFile(t, "access_key: access\nsecret_key: secret\ntargets:\n  - rgw_url: http://east.example.com/\n")
+
+	v, err := newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+	require.Len(t, cfg.targets, 1)
+	require.Empty(t, cfg.targets[0].name)
+	require.NotContains(t, cfg.targets[0].labels, clusterLabel)
+}
+
+func TestLoadConfigTargetInheritance(t *testing.T) {
+	configFile := writeConfigFile(t, `
+access_key: access
+secret_key: secret
+interval: 2m
+signing_region: zg1
+targets:
+  - name: east
+    rgw_url: http://east.example.com/
+  - name: west
+    rgw_url: http://west.example.com/
+    access_key: west-access
+    secret_key: west-secret
+    interval: 5m
+    signing_region: zg2
+`)
+
+	v, err := newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+	require.Len(t, cfg.targets, 2)
+
+	// The targets use the top level settings they don't set themselves
+	east := cfg.targets[0]
+	creds, err := east.signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access", creds.AccessKeyID)
+	require.Equal(t, "secret", creds.SecretAccessKey)
+	require.Equal(t, 2*time.Minute, east.opts.Interval)
+	require.Equal(t, "zg1", east.signer.region)
+
+	west := cfg.targets[1]
+	creds, err = west.signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "west-access", creds.AccessKeyID)
+	require.Equal(t, "west-secret", creds.SecretAccessKey)
+	require.Equal(t, 5*time.Minute, west.opts.Interval)
+	require.Equal(t, "zg2", west.signer.region)
+}
+
+func TestLoadConfigProbeModuleTargets(t *testing.T) {
+	for name, module := range map[string]string{
+		"missing": "    access_key: access\n",
+		"invalid": "    targets: [objects.example.com]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			configFile := writeConfigFile(t, "access_key: access\nsecret_key: secret\nmodules:\n  default:\n"+module)
+
+			v, err := newViper([]string{"--config", configFile})
+			require.NoError(t, err)
+
+			_, err = loadConfig(v)
+			require.ErrorContains(t, err, "modules.default.targets")
+		})
+	}
+
+	configFile := writeConfigFile(t, "access_key: access\nsecret_key: secret\nmodules:\n  default:\n    targets: [https://objects.example.com/]\n")
+
+	v, err := newViper([]string{"--config", configFile})
+	require.NoError(t, err)
+
+	cfg, err := loadConfig(v)
+	require.NoError(t, err)
+
+	module := cfg.modules[defaultProbeModule]
+	require.True(t, module.allows(&url.URL{Scheme: "https", Host: "OBJECTS.example.com"}))
+	require.False(t, module.allows(&url.URL{Scheme: "http", Host: "objects.example.com"}))
+	require.False(t, module.allows(&url.URL{Scheme: "https", Host: "objects.example.com:8443"}))
+}
@@ -0,0 +1,328 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/xhit/go-str2duration"
+)
+
+const (
+	credentialsStatic  = "static"
+	credentialsCommand = "command"
+	credentialsVault   = "vault"
+
+	defaultCredentialsCommandTimeout = time.Minute
+	defaultCredentialsExpiryWindow   = time.Minute
+	// defaultVaultTimeout limits the Vault requests if there is no request timeout, so a hung Vault doesn't block the scrapes forever
+	defaultVaultTimeout = time.Minute
+
+	defaultVaultAccessKeyField = "access_key"
+	defaultVaultSecretKeyField = "secret_key"
+)
+
+// credentialsConfig selects where the credentials used to sign the admin API requests come from
+// The `static` type uses the access_key / secret_key settings
+type credentialsConfig struct {
+	Type string `mapstructure:"type"`
+
+	// Command is run with `sh -c`, and must print the credentials in the AWS `credential_process` JSON format
+	Command        string `mapstructure:"command"`
+	CommandTimeout string `mapstructure:"command_timeout"`
+
+	Vault vaultConfig `mapstructure:"vault"`
+
+	// RefreshInterval is the maximum amount of time the credentials are used before they are fetched again
+	// If it is empty, they are only fetched again when they expire. Credentials without an expiration are fetched once
+	RefreshInterval string `mapstructure:"refresh_interval"`
+	// ExpiryWindow is how long before they expire the credentials are fetched again
+	ExpiryWindow string `mapstructure:"expiry_window"`
+}
+
+// vaultConfig is the location of the credentials in a Vault KV secrets engine, or any HTTP server with a compatible API
+type vaultConfig struct {
+	Address   string `mapstructure:"address"`
+	Path      string `mapstructure:"path"`
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"`
+	// CAFile is a PEM bundle of the CAs used to verify the Vault certificate, instead of the system CAs
+	CAFile string `mapstructure:"ca_file"`
+
+	// AccessKeyField and SecretKeyField are the keys of the secret's data that contain the credentials
+	AccessKeyField string `mapstructure:"access_key_field"`
+	SecretKeyField string `mapstructure:"secret_key_field"`
+}
+
+// isStatic returns true if the credentials are given directly with access_key / secret_key
+func (c *credentialsConfig) isStatic() bool {
+	return c == nil || c.Type == "" || c.Type == credentialsStatic
+}
+
+// newCredentialsProvider creates the provider of the non-static credentials described by cfg
+// `field` is the name of the setting, used in error messages
+func newCredentialsProvider(cfg credentialsConfig, field func(key string) string, secrets *secretReader, requestTimeout time.Duration) (*credentials.Credentials, error) {
+	expiry := providerExpiry{
+		expiryWindow: defaultCredentialsExpiryWindow,
+	}
+
+	var err error
+	if cfg.RefreshInterval != "" {
+		expiry.refreshInterval, err = str2duration.Str2Duration(cfg.RefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s `%s` as a duration - %w", field("refresh_interval"), cfg.RefreshInterval, err)
+		}
+	}
+	if cfg.ExpiryWindow != "" {
+		expiry.expiryWindow, err = str2duration.Str2Duration(cfg.ExpiryWindow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s `%s` as a duration - %w", field("expiry_window"), cfg.ExpiryWindow, err)
+		}
+	}
+
+	switch cfg.Type {
+	case credentialsCommand:
+		if cfg.Command == "" {
+			return nil, fmt.Errorf("%s is a required argument", field("command"))
+		}
+
+		timeout := defaultCredentialsCommandTimeout
+		if cfg.CommandTimeout != "" {
+			timeout, err = str2duration.Str2Duration(cfg.CommandTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s `%s` as a duration - %w", field("command_timeout"), cfg.CommandTimeout, err)
+			}
+		}
+
+		return credentials.NewCredentials(&commandProvider{
+			providerExpiry: expiry,
+			command:        cfg.Command,
+			timeout:        timeout,
+		}), nil
+
+	case credentialsVault:
+		if cfg.Vault.Address == "" {
+			return nil, fmt.Errorf("%s is a required argument", field("vault.address"))
+		}
+		if cfg.Vault.Path == "" {
+			return nil, fmt.Errorf("%s is a required argument", field("vault.path"))
+		}
+
+		secretURL, err := url.Parse(strings.TrimSuffix(cfg.Vault.Address, "/") + "/v1/" + strings.TrimPrefix(cfg.Vault.Path, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s `%s` - %w", field("vault.address"), cfg.Vault.Address, err)
+		}
+
+		token, err := secrets.read(field("vault.token"), cfg.Vault.Token, field("vault.token_file"), cfg.Vault.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		vaultTLSConfig, err := newTLSConfig(&tlsConfig{CAFile: cfg.Vault.CAFile}, func(key string) string { return field("vault." + key) }, secrets)
+		if err != nil {
+			return nil, err
+		}
+
+		if requestTimeout <= 0 {
+			requestTimeout = defaultVaultTimeout
+		}
+
+		client := &http.Client{Timeout: requestTimeout}
+		if vaultTLSConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = vaultTLSConfig
+			client.Transport = transport
+		}
+
+		provider := &vaultProvider{
+			providerExpiry: expiry,
+			client:         client,
+			secretURL:      secretURL,
+			token:          token,
+			accessKeyField: cfg.Vault.AccessKeyField,
+			secretKeyField: cfg.Vault.SecretKeyField,
+		}
+		if provider.accessKeyField == "" {
+			provider.accessKeyField = defaultVaultAccessKeyField
+		}
+		if provider.secretKeyField == "" {
+			provider.secretKeyField = defaultVaultSecretKeyField
+		}
+
+		return credentials.NewCredentials(provider), nil
+
+	default:
+		return nil, fmt.Errorf("%s `%s` is not one of [%s, %s, %s]", field("type"), cfg.Type, credentialsStatic, credentialsCommand, credentialsVault)
+	}
+}
+
+// providerExpiry decides when the credentials of a provider must be fetched again
+type providerExpiry struct {
+	credentials.Expiry
+
+	refreshInterval time.Duration
+	expiryWindow    time.Duration
+	// neverExpires is set if the credentials have no expiration, and there is no refresh interval
+	neverExpires bool
+}
+
+// update sets the expiration of newly fetched credentials. A zero `expiration` means the source didn't give one
+func (e *providerExpiry) update(expiration time.Time) {
+	now := time.Now()
+	if e.CurrentTime != nil {
+		now = e.CurrentTime()
+	}
+	if e.refreshInterval > 0 && (expiration.IsZero() || now.Add(e.refreshInterval).Before(expiration)) {
+		expiration = now.Add(e.refreshInterval)
+	}
+
+	e.neverExpires = expiration.IsZero()
+	if !e.neverExpires {
+		e.SetExpiration(expiration, e.expiryWindow)
+	}
+}
+
+func (e *providerExpiry) IsExpired() bool {
+	if e.neverExpires {
+		return false
+	}
+
+	return e.Expiry.IsExpired()
+}
+
+// commandProvider fetches the credentials by running an external helper command
+// The command must print the credentials in the AWS `credential_process` JSON format. IE:
+//
+//	{"Version": 1, "AccessKeyId": "...", "SecretAccessKey": "...", "Expiration": "2023-01-01T00:00:00Z"}
+type commandProvider struct {
+	providerExpiry
+
+	command string
+	timeout time.Duration
+}
+
+func (p *commandProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(context.Background())
+}
+
+func (p *commandProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+	cmd.Env = os.Environ()
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to run credentials command - %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := processcreds.CredentialProcessResponse{}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to parse credentials command output - %w", err)
+	}
+	if resp.Version != 1 {
+		return credentials.Value{}, fmt.Errorf("credentials command output has unsupported Version %d", resp.Version)
+	}
+	if resp.AccessKeyID == "" || resp.SecretAccessKey == "" {
+		return credentials.Value{}, fmt.Errorf("credentials command output is missing AccessKeyId or SecretAccessKey")
+	}
+
+	var expiration time.Time
+	if resp.Expiration != nil {
+		expiration = *resp.Expiration
+	}
+	p.update(expiration)
+
+	return credentials.Value{
+		AccessKeyID:     resp.AccessKeyID,
+		SecretAccessKey: resp.SecretAccessKey,
+		SessionToken:    resp.SessionToken,
+		ProviderName:    "CommandProvider",
+	}, nil
+}
+
+// vaultProvider fetches the credentials from a secret in a Vault KV secrets engine, version 1 or 2
+type vaultProvider struct {
+	providerExpiry
+
+	client    *http.Client
+	secretURL *url.URL
+	token     string
+
+	accessKeyField string
+	secretKeyField string
+}
+
+// vaultSecretResponse is the response to reading a Vault secret
+// For KV version 2, the secret's data is nested in another `data` object, next to its `metadata`
+type vaultSecretResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+func (p *vaultProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(context.Background())
+}
+
+func (p *vaultProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.secretURL.String(), nil)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to create request - %w", err)
+	}
+	if p.token != "" {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to query vault - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("request to vault returned %d", resp.StatusCode)
+	}
+
+	secret := vaultSecretResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to parse vault response - %w", err)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	accessKey, _ := data[p.accessKeyField].(string)
+	if accessKey == "" {
+		return credentials.Value{}, fmt.Errorf("vault secret has no `%s` field", p.accessKeyField)
+	}
+	secretKey, _ := data[p.secretKeyField].(string)
+	if secretKey == "" {
+		return credentials.Value{}, fmt.Errorf("vault secret has no `%s` field", p.secretKeyField)
+	}
+
+	var expiration time.Time
+	if secret.LeaseDuration > 0 {
+		expiration = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+	}
+	p.update(expiration)
+
+	return credentials.Value{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		ProviderName:    "VaultProvider",
+	}, nil
+}
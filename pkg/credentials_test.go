@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultCredentials(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/rgw-exporter" || r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// A KV version 2 response
+		n := atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{
+			"lease_duration": 0,
+			"data": {
+				"data": {"access_key": "access-%d", "secret_key": "secret-%d"},
+				"metadata": {"version": %d}
+			}
+		}`, n, n, n)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := credentialsConfig{
+		Type:            credentialsVault,
+		RefreshInterval: "1h",
+		Vault: vaultConfig{
+			Address: server.URL,
+			Path:    "secret/data/rgw-exporter",
+			Token:   "token",
+		},
+	}
+	field := func(key string) string { return "credentials." + key }
+
+	creds, err := newCredentialsProvider(cfg, field, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	value, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access-1", value.AccessKeyID)
+	require.Equal(t, "secret-1", value.SecretAccessKey)
+
+	// The credentials are cached until the refresh interval passes
+	value, err = creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access-1", value.AccessKeyID)
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	// They are fetched again once it passes
+	now := time.Now()
+	secretURL, err := url.Parse(server.URL + "/v1/secret/data/rgw-exporter")
+	require.NoError(t, err)
+
+	provider := &vaultProvider{
+		providerExpiry: providerExpiry{refreshInterval: time.Hour},
+		client:         server.Client(),
+		secretURL:      secretURL,
+		token:          "token",
+		accessKeyField: defaultVaultAccessKeyField,
+		secretKeyField: defaultVaultSecretKeyField,
+	}
+	provider.CurrentTime = func() time.Time { return now }
+	creds = credentials.NewCredentials(provider)
+
+	value, err = creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access-2", value.AccessKeyID)
+
+	now = now.Add(2 * time.Hour)
+	require.True(t, creds.IsExpired())
+
+	value, err = creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access-3", value.AccessKeyID)
+
+	// Failures are returned to the caller
+	cfg.Vault.Token = "wrong-token"
+	creds, err = newCredentialsProvider(cfg, field, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	_, err = creds.Get()
+	require.ErrorContains(t, err, "403")
+}
+
+func TestVaultCredentialsCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"access_key": "access", "secret_key": "secret"}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	cfg := credentialsConfig{
+		Type: credentialsVault,
+		Vault: vaultConfig{
+			Address: server.URL,
+			Path:    "secret/rgw-exporter",
+			Token:   "token",
+		},
+	}
+	field := func(key string) string { return "credentials." + key }
+
+	// The certificate of the test server isn't signed by a system CA
+	creds, err := newCredentialsProvider(cfg, field, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	_, err = creds.Get()
+	require.Error(t, err)
+
+	cfg.Vault.CAFile = caFile
+	creds, err = newCredentialsProvider(cfg, field, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	value, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access", value.AccessKeyID)
+}
+
+func TestCommandCredentials(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	cfg := credentialsConfig{
+		Type:    credentialsCommand,
+		Command: fmt.Sprintf(`echo '{"Version": 1, "AccessKeyId": "access", "SecretAccessKey": "secret", "Expiration": "%s"}'`, expiration),
+	}
+
+	creds, err := newCredentialsProvider(cfg, func(key string) string { return key }, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	value, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "access", value.AccessKeyID)
+	require.Equal(t, "secret", value.SecretAccessKey)
+	require.False(t, creds.IsExpired())
+
+	cfg.Command = "echo 'not json'"
+	creds, err = newCredentialsProvider(cfg, func(key string) string { return key }, &secretReader{}, time.Minute)
+	require.NoError(t, err)
+
+	_, err = creds.Get()
+	require.Error(t, err)
+}
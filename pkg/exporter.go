@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// exporter owns the running targets and the probe modules, and swaps them when the configuration is reloaded
+type exporter struct {
+	ctx      context.Context
+	log      *logrus.Logger
+	registry *prometheus.Registry
+	// args are the command line arguments, which are parsed again on each reload
+	args []string
+	// secretWatcher is told about the files the secrets are read from, so the config is reloaded when they change. It is optional
+	secretWatcher *fileWatcher
+
+	// reloadMu serializes reloads, so targets are never started twice
+	reloadMu sync.Mutex
+
+	mu sync.RWMutex
+	// applied is set once the first config is applied
+	applied       bool
+	port          int
+	webConfigFile string
+	readiness     readinessConfig
+	targets       map[string]*runningTarget
+	modules       map[string]*probeModule
+
+	lastReloadSuccessful       prometheus.Gauge
+	lastReloadSuccessTimestamp prometheus.Gauge
+}
+
+// runningTarget is a target that is being scraped in the background
+type runningTarget struct {
+	*rgwTarget
+
+	metrics    *RGWMetrics
+	registerer prometheus.Registerer
+	// cancel stops the scrape goroutines of the target. The metrics are kept
+	cancel context.CancelFunc
+}
+
+// newExporter creates an exporter that registers all the target metrics with `registry`
+// Nothing is scraped until a config is applied
+func newExporter(ctx context.Context, log *logrus.Logger, registry *prometheus.Registry, args []string, secretWatcher *fileWatcher) *exporter {
+	e := &exporter{
+		ctx:           ctx,
+		log:           log,
+		registry:      registry,
+		args:          args,
+		secretWatcher: secretWatcher,
+		targets:       map[string]*runningTarget{},
+		modules:       map[string]*probeModule{},
+
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "radosgw_exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful",
+		}),
+		lastReloadSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "radosgw_exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload",
+		}),
+	}
+
+	registry.MustRegister(e.lastReloadSuccessful, e.lastReloadSuccessTimestamp)
+
+	return e
+}
+
+// reload reads the configuration again, and applies it if it is valid
+// If it is not, the current configuration is kept
+func (e *exporter) reload() error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	v, err := newViper(e.args)
+	if err != nil {
+		e.lastReloadSuccessful.Set(0)
+		return err
+	}
+
+	cfg, err := loadConfig(v)
+	if err != nil {
+		e.lastReloadSuccessful.Set(0)
+		return err
+	}
+
+	e.applyConfig(cfg)
+	return nil
+}
+
+// applyConfig starts scraping the targets in cfg, and stops scraping the targets that are no longer in it
+// Targets are matched by name. A target that is kept keeps its metrics, unless its labels changed
+func (e *exporter) applyConfig(cfg *exporterConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.log.SetLevel(cfg.logLevel)
+
+	// The server is only started once, so its settings can't be reloaded
+	if !e.applied {
+		e.port = cfg.port
+		e.webConfigFile = cfg.webConfigFile
+		e.applied = true
+	}
+	if cfg.port != e.port {
+		e.log.Warnf("Changing the port from %d to %d requires a restart. Still listening on %d", e.port, cfg.port, e.port)
+	}
+	if cfg.webConfigFile != e.webConfigFile {
+		// Changes to the contents of the file are picked up without a restart
+		e.log.Warnf("Changing the web config file from `%s` to `%s` requires a restart", e.webConfigFile, cfg.webConfigFile)
+	}
+
+	targets := map[string]*runningTarget{}
+	for _, target := range cfg.targets {
+		running, ok := e.targets[target.name]
+		if ok {
+			// Stop the old scrape goroutines. They are restarted below with the new settings
+			running.cancel()
+
+			if !labelsEqual(running.labels, target.labels) {
+				// The metrics are identified by their labels, so they can't be kept
+				running.metrics.Unregister(running.registerer)
+				ok = false
+			}
+		}
+
+		if !ok {
+			var registerer prometheus.Registerer = e.registry
+			if len(target.labels) > 0 {
+				registerer = prometheus.WrapRegistererWith(target.labels, e.registry)
+			}
+
+			running = &runningTarget{
+				metrics:    NewRGWMetrics(registerer),
+				registerer: registerer,
+			}
+		}
+
+		targetLog := logrus.FieldLogger(e.log)
+		if target.name != "" {
+			targetLog = e.log.WithField(clusterLabel, target.name)
+		}
+
+		// The health checks use the target's client too, so it is instrumented once for both
+		target.client = running.metrics.InstrumentClient(target.client)
+
+		ctx, cancel := context.WithCancel(e.ctx)
+		running.rgwTarget = target
+		running.cancel = cancel
+		running.metrics.StartScraping(ctx, targetLog, target.client, target.rgwURL, target.signer, target.opts)
+
+		targets[target.name] = running
+	}
+
+	// Stop the targets that were removed from the config, and drop their metrics
+	for name, running := range e.targets {
+		if _, ok := targets[name]; !ok {
+			running.cancel()
+			running.metrics.Unregister(running.registerer)
+		}
+	}
+
+	e.targets = targets
+	e.modules = cfg.modules
+	e.readiness = cfg.readiness
+
+	if e.secretWatcher != nil {
+		if err := e.secretWatcher.setFiles(cfg.secretFiles); err != nil {
+			e.log.Errorf("Failed to watch the secret files. Changes to them won't be reloaded - %v", err)
+		}
+	}
+
+	e.lastReloadSuccessful.Set(1)
+	e.lastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+}
+
+// targetList returns the targets that are currently scraped
+func (e *exporter) targetList() []*runningTarget {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	targets := make([]*runningTarget, 0, len(e.targets))
+	for _, running := range e.targets {
+		targets = append(targets, running)
+	}
+
+	return targets
+}
+
+// checkReadiness checks the health of the targets that are currently scraped
+func (e *exporter) checkReadiness(ctx context.Context) readinessResponse {
+	e.mu.RLock()
+	readiness := e.readiness
+	e.mu.RUnlock()
+
+	return checkReadiness(ctx, e.targetList(), readiness, time.Now())
+}
+
+// probeModules returns the modules that can currently be used by the /probe endpoint
+func (e *exporter) probeModules() map[string]*probeModule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.modules
+}
+
+func labelsEqual(a prometheus.Labels, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporterReload(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	writeConfig := func(path string, secretKey string) {
+		contents := fmt.Sprintf("rgw_url: %s\naccess_key: access\nsecret_key: %s\ninterval: 1h\n", rgwURL, secretKey)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+
+	configFile := writeConfigFile(t, "")
+	writeConfig(configFile, "old-secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exp := newExporter(ctx, logrus.New(), prometheus.NewRegistry(), []string{"--config", configFile}, nil)
+	require.NoError(t, exp.reload())
+	require.Equal(t, 1.0, testutil.ToFloat64(exp.lastReloadSuccessful))
+
+	metrics := exp.targets[""].metrics
+	creds, err := exp.targetList()[0].signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "old-secret", creds.SecretAccessKey)
+
+	// The new credentials are used, and the metrics are kept
+	writeConfig(configFile, "new-secret")
+	require.NoError(t, exp.reload())
+	require.Equal(t, 1.0, testutil.ToFloat64(exp.lastReloadSuccessful))
+	require.Same(t, metrics, exp.targets[""].metrics)
+
+	creds, err = exp.targetList()[0].signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "new-secret", creds.SecretAccessKey)
+
+	// An invalid config is reported, and the current config is kept
+	require.NoError(t, os.WriteFile(configFile, []byte("interval: not-a-duration\n"), 0o600))
+	require.Error(t, exp.reload())
+	require.Equal(t, 0.0, testutil.ToFloat64(exp.lastReloadSuccessful))
+
+	creds, err = exp.targetList()[0].signer.creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "new-secret", creds.SecretAccessKey)
+}
+
+func TestExporterReloadDisablesCollector(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/usage" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprint(w, `{"entries": [{"user": "alice", "buckets": [{"bucket": "photos", "owner": "alice", "categories": [{"category": "get_obj", "ops": 3}]}]}]}`)
+	})
+
+	writeConfig := func(path string, opsEnabled bool) {
+		contents := fmt.Sprintf("rgw_url: %s\naccess_key: access\nsecret_key: secret\ninterval: 1h\nstartup_jitter: 0s\ncollectors:\n  ops:\n    enabled: %t\n", rgwURL, opsEnabled)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+
+	configFile := writeConfigFile(t, "")
+	writeConfig(configFile, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	exp := newExporter(ctx, logrus.New(), registry, []string{"--config", configFile}, nil)
+	require.NoError(t, exp.reload())
+
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(registry, "radosgw_usage_opts_total") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "radosgw_usage_last_success_timestamp_seconds"))
+
+	// The series of the disabled collector are dropped
+	writeConfig(configFile, false)
+	require.NoError(t, exp.reload())
+
+	require.Equal(t, 0, testutil.CollectAndCount(registry, "radosgw_usage_opts_total"))
+	require.Equal(t, 0, testutil.CollectAndCount(registry, "radosgw_usage_last_success_timestamp_seconds"))
+}
+
+func TestExporterTargetClusterLabel(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/usage" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprint(w, `{"entries": [{"user": "alice", "buckets": [{"bucket": "photos", "owner": "alice", "categories": [{"category": "get_obj", "ops": 3}]}]}]}`)
+	})
+
+	configFile := writeConfigFile(t, fmt.Sprintf(`
+access_key: access
+secret_key: secret
+interval: 1h
+startup_jitter: 0s
+labels:
+  env: prod
+collectors:
+  buckets:
+    enabled: false
+  users:
+    enabled: false
+targets:
+  - name: east
+    rgw_url: %[1]s
+  - name: west
+    rgw_url: %[1]s
+`, rgwURL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	exp := newExporter(ctx, logrus.New(), registry, []string{"--config", configFile}, nil)
+	require.NoError(t, exp.reload())
+
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(registry, "radosgw_usage_opts_total") == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The metrics of each target are told apart by the `cluster` label, on top of the common labels
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	clusters := []string{}
+	for _, family := range families {
+		if family.GetName() != "radosgw_usage_opts_total" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+
+			require.Equal(t, "prod", labels["env"])
+			clusters = append(clusters, labels[clusterLabel])
+		}
+	}
+	require.ElementsMatch(t, []string{"east", "west"}, clusters)
+}
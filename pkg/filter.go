@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// NameFilter decides which buckets or users are exported, based on their name
+// A nil NameFilter keeps every name
+type NameFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewNameFilter compiles a filter that keeps the names that fully match at least one of the `include`
+// regexes (or all names, if `include` is empty), and don't fully match any of the `exclude` regexes
+// It returns nil if both lists are empty
+func NewNameFilter(include []string, exclude []string) (*NameFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	filter := &NameFilter{}
+
+	var err error
+	if filter.include, err = compileAnchoredRegexes(include); err != nil {
+		return nil, err
+	}
+	if filter.exclude, err = compileAnchoredRegexes(exclude); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Keep returns true if `name` passes the filter
+func (f *NameFilter) Keep(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileAnchoredRegexes compiles each pattern so it only matches whole names, the same way Prometheus relabeling does
+func compileAnchoredRegexes(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile regex `%s` - %w", pattern, err)
+		}
+
+		regexes = append(regexes, re)
+	}
+
+	return regexes, nil
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adminAPIMetrics are the self-metrics of the requests made to RGW
+type adminAPIMetrics struct {
+	requestDurationSeconds *prometheus.HistogramVec
+	responsesTotal         *prometheus.CounterVec
+	responseSizeBytes      *prometheus.HistogramVec
+	retriesTotal           *prometheus.CounterVec
+}
+
+func newAdminAPIMetrics() *adminAPIMetrics {
+	return &adminAPIMetrics{
+		requestDurationSeconds: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "radosgw_exporter",
+				Subsystem: "admin_api",
+				Name:      "request_duration_seconds",
+				Help:      "Amount of time each request to RGW takes, including reading the response",
+				// Usage and bucket stats requests can take minutes on large clusters
+				Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			},
+			[]string{"endpoint"},
+		),
+		responsesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "radosgw_exporter",
+				Subsystem: "admin_api",
+				Name:      "responses_total",
+				Help:      "Number of responses to the requests to RGW, by status code. Requests that failed without a response have the `error` code",
+			},
+			[]string{"endpoint", "code"},
+		),
+		responseSizeBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "radosgw_exporter",
+				Subsystem: "admin_api",
+				Name:      "response_size_bytes",
+				Help:      "Size of the response bodies returned by RGW",
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+			},
+			[]string{"endpoint"},
+		),
+		retriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "radosgw_exporter",
+				Subsystem: "admin_api",
+				Name:      "retries_total",
+				Help:      "Number of times a failed admin API request was retried",
+			},
+			[]string{"endpoint"},
+		),
+	}
+}
+
+func (m *adminAPIMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requestDurationSeconds.Describe(ch)
+	m.responsesTotal.Describe(ch)
+	m.responseSizeBytes.Describe(ch)
+	m.retriesTotal.Describe(ch)
+}
+
+func (m *adminAPIMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requestDurationSeconds.Collect(ch)
+	m.responsesTotal.Collect(ch)
+	m.responseSizeBytes.Collect(ch)
+	m.retriesTotal.Collect(ch)
+}
+
+// instrumentClient returns a copy of `client` that records the metrics of every request it sends
+func (m *adminAPIMetrics) instrumentClient(client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	instrumentedClient := *client
+	instrumentedClient.Transport = &instrumentTransport{
+		next:    next,
+		metrics: m,
+	}
+
+	return &instrumentedClient
+}
+
+// instrumentTransport records the metrics of the requests to RGW
+// The duration and size of a response are recorded once its body is closed, so they include reading the body
+type instrumentTransport struct {
+	next    http.RoundTripper
+	metrics *adminAPIMetrics
+}
+
+func (t *instrumentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := adminEndpoint(req.URL)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.metrics.responsesTotal.WithLabelValues(endpoint, "error").Inc()
+		t.metrics.requestDurationSeconds.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+
+	t.metrics.responsesTotal.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &instrumentedBody{
+		ReadCloser: resp.Body,
+		onClose: func(size int64) {
+			t.metrics.requestDurationSeconds.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+			t.metrics.responseSizeBytes.WithLabelValues(endpoint).Observe(float64(size))
+		},
+	}
+
+	return resp, nil
+}
+
+// instrumentedBody counts the bytes read from a response body, and calls onClose with the total once it is closed
+type instrumentedBody struct {
+	io.ReadCloser
+
+	size    int64
+	once    sync.Once
+	onClose func(size int64)
+}
+
+func (b *instrumentedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *instrumentedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.onClose(b.size) })
+	return err
+}
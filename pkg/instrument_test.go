@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentClient(t *testing.T) {
+	body := `{"entries": [{"user": "alice"}]}`
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/usage":
+			fmt.Fprint(w, body)
+		case "/swift/healthcheck":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	client := metrics.InstrumentClient(makeHTTPClient(time.Minute, nil))
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	for i := 0; i < 2; i++ {
+		err := getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error { return nil })
+		require.NoError(t, err)
+	}
+	_, err := getCephUserInfo(context.Background(), client, rgwURL, signer, "alice", false)
+	require.Error(t, err)
+	require.Error(t, cephHealthCheck(context.Background(), client, rgwURL))
+
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.adminAPI.responsesTotal.WithLabelValues("usage", "200")))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.adminAPI.responsesTotal.WithLabelValues("user", "404")))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.adminAPI.responsesTotal.WithLabelValues("healthcheck", "503")))
+
+	histogram := func(vec *prometheus.HistogramVec, endpoint string) *dto.Histogram {
+		metric := &dto.Metric{}
+		require.NoError(t, vec.WithLabelValues(endpoint).(prometheus.Histogram).Write(metric))
+		return metric.GetHistogram()
+	}
+
+	require.Equal(t, uint64(2), histogram(metrics.adminAPI.requestDurationSeconds, "usage").GetSampleCount())
+	require.Equal(t, uint64(1), histogram(metrics.adminAPI.requestDurationSeconds, "healthcheck").GetSampleCount())
+	require.Equal(t, uint64(2), histogram(metrics.adminAPI.responseSizeBytes, "usage").GetSampleCount())
+	// The decoder may stop before the trailing newline, but reads the whole object
+	require.GreaterOrEqual(t, histogram(metrics.adminAPI.responseSizeBytes, "usage").GetSampleSum(), float64(2*len(body)))
+
+	// Requests that fail without a response are counted as errors
+	client = metrics.InstrumentClient(makeHTTPClient(time.Minute, nil))
+	rgwURL.Host = "127.0.0.1:1"
+	require.Error(t, cephHealthCheck(context.Background(), client, rgwURL))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.adminAPI.responsesTotal.WithLabelValues("healthcheck", "error")))
+}
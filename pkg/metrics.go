@@ -2,30 +2,35 @@ package pkg
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type RGWMetrics struct {
-	registry *prometheus.Registry
-
 	ops        *operationsCollector
 	bucketInfo *bucketsCollector
 	userInfo   *userInfoCollector
 
 	// Misc
-	scrapeDurationSeconds *prometheus.GaugeVec
-	scrapeCountTotal      *prometheus.CounterVec
+	scrapeDurationSeconds       *prometheus.GaugeVec
+	scrapeCountTotal            *prometheus.CounterVec
+	lastSuccessTimestampSeconds *prometheus.GaugeVec
+
+	// Admin API
+	adminAPI *adminAPIMetrics
 }
 
-func NewRGWMetrics() *RGWMetrics {
+// NewRGWMetrics creates the metrics of a single RGW instance, and registers them with `registerer`
+func NewRGWMetrics(registerer prometheus.Registerer) *RGWMetrics {
 	scrapeDurationSeconds := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "radosgw_usage",
@@ -42,57 +47,463 @@ func NewRGWMetrics() *RGWMetrics {
 		},
 		[]string{"type", "status"},
 	)
+	lastSuccessTimestampSeconds := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "radosgw_usage",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix timestamp of the start of the last successful scrape",
+		},
+		[]string{"type"},
+	)
 
 	metrics := &RGWMetrics{
-		registry: prometheus.NewRegistry(),
+		ops:        newOperationsCollector(scrapeDurationSeconds, scrapeCountTotal, lastSuccessTimestampSeconds),
+		bucketInfo: newBucketsCollector(scrapeDurationSeconds, scrapeCountTotal, lastSuccessTimestampSeconds),
+		userInfo:   newUserInfoCollector(scrapeDurationSeconds, scrapeCountTotal, lastSuccessTimestampSeconds),
 
-		ops:        newOperationsCollector(scrapeDurationSeconds, scrapeCountTotal),
-		bucketInfo: newBucketsCollector(scrapeDurationSeconds, scrapeCountTotal),
-		userInfo:   newUserInfoCollector(scrapeDurationSeconds, scrapeCountTotal),
+		scrapeDurationSeconds:       scrapeDurationSeconds,
+		scrapeCountTotal:            scrapeCountTotal,
+		lastSuccessTimestampSeconds: lastSuccessTimestampSeconds,
 
-		scrapeDurationSeconds: scrapeDurationSeconds,
-		scrapeCountTotal:      scrapeCountTotal,
+		adminAPI: newAdminAPIMetrics(),
 	}
 
-	metrics.registry.MustRegister(metrics.ops)
-	metrics.registry.MustRegister(metrics.bucketInfo)
-	metrics.registry.MustRegister(metrics.userInfo)
-	metrics.registry.MustRegister(metrics.scrapeDurationSeconds)
-	metrics.registry.MustRegister(metrics.scrapeCountTotal)
+	registerer.MustRegister(metrics.ops)
+	registerer.MustRegister(metrics.bucketInfo)
+	registerer.MustRegister(metrics.userInfo)
+	registerer.MustRegister(metrics.scrapeDurationSeconds)
+	registerer.MustRegister(metrics.scrapeCountTotal)
+	registerer.MustRegister(metrics.lastSuccessTimestampSeconds)
+	registerer.MustRegister(metrics.adminAPI)
 
 	return metrics
 }
 
-// StartScraping will launch goroutines to scrape RGW metrics from Ceph at `interval` time period
-func (m *RGWMetrics) StartScraping(ctx context.Context, log *logrus.Logger, client *http.Client, rgwURL *url.URL, creds *credentials.Credentials, interval time.Duration) {
-	go m.ops.FetchMetrics(ctx, log, client, rgwURL, creds, interval)
-	go m.bucketInfo.FetchMetrics(ctx, log, client, rgwURL, creds, interval)
-	go m.userInfo.FetchMetrics(ctx, log, client, rgwURL, creds, interval)
+// Unregister removes the metrics from `registerer`, which must be the one they were created with
+func (m *RGWMetrics) Unregister(registerer prometheus.Registerer) {
+	registerer.Unregister(m.ops)
+	registerer.Unregister(m.bucketInfo)
+	registerer.Unregister(m.userInfo)
+	registerer.Unregister(m.scrapeDurationSeconds)
+	registerer.Unregister(m.scrapeCountTotal)
+	registerer.Unregister(m.lastSuccessTimestampSeconds)
+	registerer.Unregister(m.adminAPI)
 }
 
-func (m *RGWMetrics) Handler() http.Handler {
-	return promhttp.InstrumentMetricHandler(
-		m.registry, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
-	)
+// ScrapeOptions controls how the collectors scrape RGW
+type ScrapeOptions struct {
+	// Interval is the minimum time period between the start of two scrapes
+	Interval time.Duration
+	// Timeout is the maximum amount of time a single scrape may take. Zero means no timeout
+	Timeout time.Duration
+	// StartupJitter is the maximum random delay before the first scrape of each collector
+	// This keeps the collectors from all scraping RGW at the same time
+	StartupJitter time.Duration
+	// MaxStaleness is how long the metrics of the last successful scrape are exported, if the following scrapes fail
+	// Zero exports them until the next successful scrape
+	MaxStaleness time.Duration
+	// SyncUserStats asks RGW to sync the user stats from the bucket indexes before returning them
+	SyncUserStats bool
+	// UserConcurrency is the maximum number of per-user requests made in parallel
+	UserConcurrency int
+	// PageSize is the maximum number of users listed per request. Zero lists all users, and all buckets, in a single request
+	PageSize int
+	// Retry controls how failed admin API requests are retried
+	Retry RetryOptions
+	// UsageStateFile is where the incremental mode of the ops collector saves its state. Empty keeps it in memory only
+	UsageStateFile string
+	// StateRetention is how long the baselines of the bucket categories that are missing from the usage log are kept. Zero keeps them forever
+	StateRetention time.Duration
+
+	Ops     CollectorOptions
+	Buckets CollectorOptions
+	Users   CollectorOptions
+
+	// BucketFilter decides which buckets are exported. Nil exports all buckets
+	BucketFilter *NameFilter
+	// UserFilter decides which users, and the buckets they own, are exported. Nil exports all users
+	UserFilter *NameFilter
 }
 
-type operationsCollector struct {
+// Collector modes
+const (
+	// collectorModeInterval scrapes RGW in the background every `Interval`, and collections return the last results
+	collectorModeInterval = "interval"
+	// collectorModeOnDemand scrapes RGW when the metrics are collected
+	collectorModeOnDemand = "on_demand"
+)
+
+// defaultOnDemandTimeout limits the on demand scrapes when no scrape timeout is set
+// It is shorter than the default scrape timeout of Prometheus, so the cached metrics can still be sent if RGW is slow
+const defaultOnDemandTimeout = defaultPrometheusScrapeTimeout - scrapeTimeoutOffset
+
+// CollectorOptions controls a single collector
+type CollectorOptions struct {
+	Enabled bool
+	// OnDemand scrapes RGW when the metrics are collected, instead of every `Interval`
+	OnDemand bool
+	// CacheTTL is the minimum time between two on demand scrapes. Collections in between return the cached metrics
+	// This keeps multiple Prometheus replicas from multiplying the load on RGW
+	CacheTTL time.Duration
+	// Interval overrides the interval of the target for this collector. Zero uses the interval of the target
+	Interval time.Duration
+	// Incremental only fetches the usage log entries that weren't fetched yet, and accumulates them. It only applies to the ops collector
+	Incremental bool
+	// Hourly also exports the usage of the most recent complete hour. It only applies to the ops collector
+	Hourly bool
+	// Summary exports the usage of each user from the usage log summary, instead of the usage of each bucket. It only applies to the ops collector
+	Summary bool
+}
+
+// interval returns the time period between two scrapes of the collector
+func (o CollectorOptions) interval(targetInterval time.Duration) time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+
+	return targetInterval
+}
+
+// waitStartupDelay waits a random delay of up to `jitter`, capped by `interval`
+// It returns false if ctx is cancelled first
+func waitStartupDelay(ctx context.Context, jitter time.Duration, interval time.Duration) bool {
+	if jitter > interval {
+		jitter = interval
+	}
+	if jitter <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(jitter))))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// InstrumentClient returns a copy of `client` that records the latency, status code, and size of the responses of RGW
+// The clients given to StartScraping and Scrape should be instrumented by the same metrics
+func (m *RGWMetrics) InstrumentClient(client *http.Client) *http.Client {
+	return m.adminAPI.instrumentClient(client)
+}
+
+// StartScraping will launch goroutines to scrape RGW metrics from Ceph at `opts.Interval` time period
+// On demand collectors are scraped when they are collected instead, until ctx is cancelled. Disabled collectors are not scraped
+func (m *RGWMetrics) StartScraping(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) {
+	client = withRetries(client, opts.Retry, m.adminAPI.retriesTotal)
+
+	// On demand scrapes are waited for by the collections, so they are always limited
+	onDemandOpts := opts
+	if onDemandOpts.Timeout <= 0 {
+		onDemandOpts.Timeout = defaultOnDemandTimeout
+	}
+
+	// Replace the on demand scrapers of the previous config, if any
+	m.ops.cache.scrapeOnDemand(ctx, nil, 0)
+	m.bucketInfo.cache.scrapeOnDemand(ctx, nil, 0)
+	m.userInfo.cache.scrapeOnDemand(ctx, nil, 0)
+
+	// Drop the metrics of the collectors that were disabled by a reload, so they aren't exported forever
+	m.setEnabled("ops", &m.ops.cache, opts.Ops.Enabled)
+	m.setEnabled("buckets", &m.bucketInfo.cache, opts.Buckets.Enabled)
+	m.setEnabled("users", &m.userInfo.cache, opts.Users.Enabled)
+
+	if opts.Ops.Enabled {
+		if opts.Ops.OnDemand {
+			m.ops.cache.scrapeOnDemand(ctx, func(ctx context.Context) error {
+				return m.ops.Scrape(ctx, log, client, rgwURL, signer, onDemandOpts)
+			}, opts.Ops.CacheTTL)
+		} else {
+			go m.ops.FetchMetrics(ctx, log, client, rgwURL, signer, opts)
+		}
+	}
+	if opts.Buckets.Enabled {
+		if opts.Buckets.OnDemand {
+			m.bucketInfo.cache.scrapeOnDemand(ctx, func(ctx context.Context) error {
+				return m.bucketInfo.Scrape(ctx, log, client, rgwURL, signer, onDemandOpts)
+			}, opts.Buckets.CacheTTL)
+		} else {
+			go m.bucketInfo.FetchMetrics(ctx, log, client, rgwURL, signer, opts)
+		}
+	}
+	if opts.Users.Enabled {
+		if opts.Users.OnDemand {
+			m.userInfo.cache.scrapeOnDemand(ctx, func(ctx context.Context) error {
+				return m.userInfo.Scrape(ctx, log, client, rgwURL, signer, onDemandOpts)
+			}, opts.Users.CacheTTL)
+		} else {
+			go m.userInfo.FetchMetrics(ctx, log, client, rgwURL, signer, opts)
+		}
+	}
+}
+
+// setEnabled enables the cache of the collector of type `collectorType`, or clears it and its last success timestamp
+func (m *RGWMetrics) setEnabled(collectorType string, cache *metricsCache, enabled bool) {
+	if enabled {
+		cache.enable()
+		return
+	}
+
+	cache.disable()
+	m.lastSuccessTimestampSeconds.DeleteLabelValues(collectorType)
+}
+
+// Scrape fetches all the metrics from Ceph once, running the enabled collectors in parallel
+// It returns an error if any of the collectors failed
+func (m *RGWMetrics) Scrape(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) error {
+	client = withRetries(client, opts.Retry, m.adminAPI.retriesTotal)
+
+	scrapers := []func() error{}
+	if opts.Ops.Enabled {
+		scrapers = append(scrapers, func() error { return m.ops.Scrape(ctx, log, client, rgwURL, signer, opts) })
+	}
+	if opts.Buckets.Enabled {
+		scrapers = append(scrapers, func() error { return m.bucketInfo.Scrape(ctx, log, client, rgwURL, signer, opts) })
+	}
+	if opts.Users.Enabled {
+		scrapers = append(scrapers, func() error { return m.userInfo.Scrape(ctx, log, client, rgwURL, signer, opts) })
+	}
+
+	errs := make([]error, len(scrapers))
+
+	var wg sync.WaitGroup
+	for i, scrape := range scrapers {
+		wg.Add(1)
+		go func(i int, scrape func() error) {
+			defer wg.Done()
+			errs[i] = scrape()
+		}(i, scrape)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scrapeContext returns the context to use for a single scrape, limited to `timeout` if it is non-zero
+func scrapeContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// scrapeStatus returns the `status` label value of scrape_count_total for a scrape that returned `err`
+func scrapeStatus(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if isTimeoutError(err) {
+		return "timeout"
+	}
+
+	return "error"
+}
+
+// metricsCache holds the metrics of the last successful scrape of a collector
+type metricsCache struct {
 	sync.Mutex
 	metrics []prometheus.Metric
 
+	scraped time.Time
+	// maxStaleness is how long the metrics are collected after they were scraped. Zero means forever
+	maxStaleness time.Duration
+	// lastErr is the error of the last scrape, or nil if it succeeded
+	lastErr error
+
+	// onDemand scrapes the metrics before they are collected. It is nil if the collector is scraped every interval
+	onDemand atomic.Pointer[onDemandScraper]
+
+	// disabled drops the metrics of scrapes that were still running when the collector was disabled
+	disabled bool
+}
+
+// enable lets the following scrapes update the cache
+func (c *metricsCache) enable() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.disabled = false
+}
+
+// disable clears the cache, and keeps the scrapes that are still running from updating it
+func (c *metricsCache) disable() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.disabled = true
+	c.metrics = nil
+	c.scraped = time.Time{}
+	c.lastErr = nil
+}
+
+// scrapeOnDemand makes collect call `scrape` first, at most once every `cacheTTL`. A nil `scrape` turns this off
+// `scrape` is given `ctx`, so it stops once ctx is cancelled. It must limit itself, since collections wait for it
+func (c *metricsCache) scrapeOnDemand(ctx context.Context, scrape func(ctx context.Context) error, cacheTTL time.Duration) {
+	if scrape == nil {
+		c.onDemand.Store(nil)
+		return
+	}
+
+	c.onDemand.Store(&onDemandScraper{
+		ctx:      ctx,
+		scrape:   scrape,
+		cacheTTL: cacheTTL,
+	})
+}
+
+// onDemandScraper scrapes a collector when it is collected
+// Concurrent collections share a single scrape, and collections within `cacheTTL` of the last scrape don't scrape again
+// The shared scrape isn't tied to any single collection, so a collection that gives up doesn't cancel it for the others
+// Instead, it is limited by the scrape timeout, which should not exceed the scrape timeout of Prometheus
+type onDemandScraper struct {
+	ctx      context.Context
+	scrape   func(ctx context.Context) error
+	cacheTTL time.Duration
+
+	group singleflight.Group
+	// lastAttempt is only accessed from within `group`, so it doesn't need its own lock
+	lastAttempt time.Time
+}
+
+// refresh scrapes the collector, unless the last scrape is more recent than the cache TTL
+// Failed scrapes are logged and counted by the collector, and its last metrics are kept
+func (s *onDemandScraper) refresh() {
+	_, _, _ = s.group.Do("scrape", func() (interface{}, error) {
+		if !s.lastAttempt.IsZero() && time.Since(s.lastAttempt) < s.cacheTTL {
+			return nil, nil
+		}
+		s.lastAttempt = time.Now()
+
+		return nil, s.scrape(s.ctx)
+	})
+}
+
+// update replaces the cached metrics with the ones scraped at `scraped`
+// It returns false if the collector was disabled, in which case the metrics are dropped
+func (c *metricsCache) update(metrics []prometheus.Metric, scraped time.Time, maxStaleness time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.disabled {
+		return false
+	}
+
+	c.metrics = metrics
+	c.scraped = scraped
+	c.maxStaleness = maxStaleness
+	c.lastErr = nil
+
+	return true
+}
+
+// fail records the error of a failed scrape. The cached metrics are kept
+func (c *metricsCache) fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lastErr = err
+}
+
+// state returns the state of the collector that owns the cache
+func (c *metricsCache) state(collectorType string, onDemand bool) collectorState {
+	c.Lock()
+	defer c.Unlock()
+
+	return collectorState{
+		collectorType: collectorType,
+		onDemand:      onDemand,
+		lastSuccess:   c.scraped,
+		lastErr:       c.lastErr,
+	}
+}
+
+// collectorState is the result of the scrapes of a collector
+type collectorState struct {
+	collectorType string
+	// onDemand collectors are only scraped when they are collected
+	onDemand bool
+	// lastSuccess is the start of the last successful scrape. It is zero if no scrape succeeded yet
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// collectorStates returns the state of the collectors enabled by `opts`
+func (m *RGWMetrics) collectorStates(opts ScrapeOptions) []collectorState {
+	states := []collectorState{}
+	if opts.Ops.Enabled {
+		states = append(states, m.ops.cache.state("ops", opts.Ops.OnDemand))
+	}
+	if opts.Buckets.Enabled {
+		states = append(states, m.bucketInfo.cache.state("buckets", opts.Buckets.OnDemand))
+	}
+	if opts.Users.Enabled {
+		states = append(states, m.userInfo.cache.state("users", opts.Users.OnDemand))
+	}
+
+	return states
+}
+
+// collect sends the cached metrics to `ch`, unless they are stale
+// On demand collectors are scraped first
+func (c *metricsCache) collect(ch chan<- prometheus.Metric) {
+	if onDemand := c.onDemand.Load(); onDemand != nil {
+		onDemand.refresh()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.maxStaleness > 0 && time.Since(c.scraped) > c.maxStaleness {
+		return
+	}
+
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+}
+
+type operationsCollector struct {
+	cache metricsCache
+
 	opsTotal           *prometheus.Desc
 	opsSuccessful      *prometheus.Desc
 	sentBytesTotal     *prometheus.Desc
 	receivedBytesTotal *prometheus.Desc
 
-	scrapeDurationSeconds *prometheus.GaugeVec
-	scrapeCountTotal      *prometheus.CounterVec
+	userOpsTotal           *prometheus.Desc
+	userOpsSuccessful      *prometheus.Desc
+	userSentBytesTotal     *prometheus.Desc
+	userReceivedBytesTotal *prometheus.Desc
+
+	hourlyOps           *prometheus.Desc
+	hourlySuccessfulOps *prometheus.Desc
+	hourlySentBytes     *prometheus.Desc
+	hourlyReceivedBytes *prometheus.Desc
+	// hourlyStartTimestamp tells which hour the hourly metrics are the usage of
+	hourlyStartTimestamp *prometheus.Desc
+
+	// usage is the usage accumulated by the incremental mode, and the baselines of the counters. It is loaded from the state file on the first scrape
+	usageMu sync.Mutex
+	usage   *usageState
+
+	scrapeDurationSeconds       *prometheus.GaugeVec
+	scrapeCountTotal            *prometheus.CounterVec
+	lastSuccessTimestampSeconds *prometheus.GaugeVec
 }
 
-func newOperationsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec) *operationsCollector {
+func newOperationsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec, lastSuccessTimestampSeconds *prometheus.GaugeVec) *operationsCollector {
 	return &operationsCollector{
-		metrics: []prometheus.Metric{},
-
 		opsTotal: prometheus.NewDesc(
 			"radosgw_usage_opts_total",
 			"Number of operations",
@@ -120,8 +531,65 @@ func newOperationsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCo
 			prometheus.Labels{},
 		),
 
-		scrapeDurationSeconds: scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "ops"}),
-		scrapeCountTotal:      scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "ops"}),
+		userOpsTotal: prometheus.NewDesc(
+			"radosgw_usage_user_ops_total",
+			"Number of operations of the user",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+		userOpsSuccessful: prometheus.NewDesc(
+			"radosgw_usage_user_successful_ops_total",
+			"Number of successful operations of the user",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+		userSentBytesTotal: prometheus.NewDesc(
+			"radosgw_usage_user_sent_bytes_total",
+			"Bytes sent by RGW to the user",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+		userReceivedBytesTotal: prometheus.NewDesc(
+			"radosgw_usage_user_received_bytes_total",
+			"Bytes received by RGW from the user",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+
+		hourlyOps: prometheus.NewDesc(
+			"radosgw_usage_hourly_ops",
+			"Number of operations in the most recent complete hour",
+			[]string{"bucket", "owner", "category"},
+			prometheus.Labels{},
+		),
+		hourlySuccessfulOps: prometheus.NewDesc(
+			"radosgw_usage_hourly_successful_ops",
+			"Number of successful operations in the most recent complete hour",
+			[]string{"bucket", "owner", "category"},
+			prometheus.Labels{},
+		),
+		hourlySentBytes: prometheus.NewDesc(
+			"radosgw_usage_hourly_sent_bytes",
+			"Bytes sent by RGW in the most recent complete hour",
+			[]string{"bucket", "owner", "category"},
+			prometheus.Labels{},
+		),
+		hourlyReceivedBytes: prometheus.NewDesc(
+			"radosgw_usage_hourly_received_bytes",
+			"Bytes received by RGW in the most recent complete hour",
+			[]string{"bucket", "owner", "category"},
+			prometheus.Labels{},
+		),
+		hourlyStartTimestamp: prometheus.NewDesc(
+			"radosgw_usage_hourly_start_timestamp_seconds",
+			"Unix timestamp of the start of the hour the hourly usage metrics are the usage of",
+			[]string{},
+			prometheus.Labels{},
+		),
+
+		scrapeDurationSeconds:       scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "ops"}),
+		scrapeCountTotal:            scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "ops"}),
+		lastSuccessTimestampSeconds: lastSuccessTimestampSeconds.MustCurryWith(prometheus.Labels{"type": "ops"}),
 	}
 }
 
@@ -130,20 +598,29 @@ func (c *operationsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.opsSuccessful
 	ch <- c.sentBytesTotal
 	ch <- c.receivedBytesTotal
+	ch <- c.userOpsTotal
+	ch <- c.userOpsSuccessful
+	ch <- c.userSentBytesTotal
+	ch <- c.userReceivedBytesTotal
+	ch <- c.hourlyOps
+	ch <- c.hourlySuccessfulOps
+	ch <- c.hourlySentBytes
+	ch <- c.hourlyReceivedBytes
+	ch <- c.hourlyStartTimestamp
 }
 
 func (c *operationsCollector) Collect(ch chan<- prometheus.Metric) {
-	c.Lock()
-	defer c.Unlock()
-
-	for _, metric := range c.metrics {
-		ch <- metric
-	}
+	c.cache.collect(ch)
 }
 
 // FetchMetrics will fetch operations metrics from Ceph in an infinite loop until ctx is cancelled
-// It uses a Ticker to attempt to fetch from Ceph every `interval` time period
-func (c *operationsCollector) FetchMetrics(ctx context.Context, log *logrus.Logger, client *http.Client, rgwURL *url.URL, creds *credentials.Credentials, interval time.Duration) {
+// It uses a Ticker to attempt to fetch from Ceph every `opts.Interval` time period, unless the collector has its own interval
+func (c *operationsCollector) FetchMetrics(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) {
+	interval := opts.Ops.interval(opts.Interval)
+	if !waitStartupDelay(ctx, opts.StartupJitter, interval) {
+		return
+	}
+
 	ticker := time.NewTicker(interval)
 
 	for {
@@ -151,124 +628,321 @@ func (c *operationsCollector) FetchMetrics(ctx context.Context, log *logrus.Logg
 			return
 		}
 
-		func() {
-			start := time.Now()
+		// Scrape logs and counts its own failures, so there is nothing left to do with the error here
+		_ = c.Scrape(ctx, log, client, rgwURL, signer, opts)
 
-			usageStats, err := getCephUsageStats(client, rgwURL, creds)
+		// Wait for the next tick event or ctx cancel
+		select {
+		case <-ticker.C:
+			// Loop
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
+// Scrape fetches the operations metrics from Ceph once, and updates the collected metrics if it succeeds
+func (c *operationsCollector) Scrape(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) error {
+	start := time.Now()
 
-			if err != nil {
-				c.scrapeCountTotal.With(prometheus.Labels{"status": "error"}).Inc()
-				log.Errorf("Failed to scrape Ceph usage stats - %v", err)
-				return
-			}
+	scrapeCtx, cancel := scrapeContext(ctx, opts.Timeout)
+	defer cancel()
 
-			c.scrapeCountTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	combinedUsageStats, hourly, err := c.scrapeUsage(scrapeCtx, log, client, rgwURL, signer, opts, start)
 
-			// Ceph will sometimes return duplicate entries with different counts
-			// We have to combine those before returning counters to Prometheus
-			type usageKey struct {
-				Owner    string
-				Bucket   string
-				Category string
-			}
+	c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
 
-			type usageValue struct {
-				OpsTotal           int64
-				OpsSuccessful      int64
-				SentBytesTotal     int64
-				ReceivedBytesTotal int64
-			}
+	if err != nil && ctx.Err() != nil {
+		// We're shutting down, so this isn't a real scrape failure
+		return err
+	}
+
+	c.scrapeCountTotal.With(prometheus.Labels{"status": scrapeStatus(err)}).Inc()
+
+	if err != nil {
+		log.Errorf("Failed to scrape Ceph usage stats - %v", err)
+		c.cache.fail(err)
+		return err
+	}
+
+	// Now create the metrics from the combined usage stats
+	// The usage of all the buckets is accumulated, so that changing the filters doesn't look like a trim. They are filtered here instead
+	metrics := []prometheus.Metric{}
+	for key, value := range combinedUsageStats {
+		// The state keeps the usage of both modes if the mode was changed, so only the usage of the current mode is exported
+		// The usage of a user has no category
+		if opts.Ops.Summary != (key.Category == "") || !opts.UserFilter.Keep(key.Owner) {
+			continue
+		}
+
+		if opts.Ops.Summary {
+			metrics = append(metrics,
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(c.userOpsTotal, prometheus.CounterValue, float64(value.OpsTotal), key.Owner),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(c.userOpsSuccessful, prometheus.CounterValue, float64(value.OpsSuccessful), key.Owner),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(c.userSentBytesTotal, prometheus.CounterValue, float64(value.SentBytesTotal), key.Owner),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(c.userReceivedBytesTotal, prometheus.CounterValue, float64(value.ReceivedBytesTotal), key.Owner),
+				),
+			)
+			continue
+		}
+
+		if !opts.BucketFilter.Keep(key.Bucket) {
+			continue
+		}
+
+		metrics = append(metrics,
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.opsTotal,
+					prometheus.CounterValue,
+					float64(value.OpsTotal),
+					key.Bucket, key.Owner, key.Category,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.opsSuccessful,
+					prometheus.CounterValue,
+					float64(value.OpsSuccessful),
+					key.Bucket, key.Owner, key.Category,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.sentBytesTotal,
+					prometheus.CounterValue,
+					float64(value.SentBytesTotal),
+					key.Bucket, key.Owner, key.Category,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.receivedBytesTotal,
+					prometheus.CounterValue,
+					float64(value.ReceivedBytesTotal),
+					key.Bucket, key.Owner, key.Category,
+				),
+			),
+		)
+	}
+
+	if hourly != nil {
+		metrics = append(metrics, c.hourlyMetrics(hourly, opts, start)...)
+	}
+
+	// Update the metrics
+	if c.cache.update(metrics, start, opts.MaxStaleness) {
+		c.lastSuccessTimestampSeconds.WithLabelValues().Set(float64(start.Unix()))
+	}
+
+	return nil
+}
+
+// hourlyMetrics creates the metrics of the usage of the most recent complete hour
+// They are timestamped with the scrape, like the other metrics. Samples timestamped with the hour would often be too old
+// for Prometheus to accept them, since an hour is only complete 5 minutes after it ends
+func (c *operationsCollector) hourlyMetrics(hourly *hourlyUsage, opts ScrapeOptions, scraped time.Time) []prometheus.Metric {
+	metrics := []prometheus.Metric{
+		prometheus.NewMetricWithTimestamp(
+			scraped,
+			prometheus.MustNewConstMetric(c.hourlyStartTimestamp, prometheus.GaugeValue, float64(hourly.Hour.Unix())),
+		),
+	}
+
+	for key, value := range hourly.Usage {
+		if !opts.UserFilter.Keep(key.Owner) || !opts.BucketFilter.Keep(key.Bucket) {
+			continue
+		}
+
+		metrics = append(metrics,
+			prometheus.NewMetricWithTimestamp(
+				scraped,
+				prometheus.MustNewConstMetric(c.hourlyOps, prometheus.GaugeValue, float64(value.OpsTotal), key.Bucket, key.Owner, key.Category),
+			),
+			prometheus.NewMetricWithTimestamp(
+				scraped,
+				prometheus.MustNewConstMetric(c.hourlySuccessfulOps, prometheus.GaugeValue, float64(value.OpsSuccessful), key.Bucket, key.Owner, key.Category),
+			),
+			prometheus.NewMetricWithTimestamp(
+				scraped,
+				prometheus.MustNewConstMetric(c.hourlySentBytes, prometheus.GaugeValue, float64(value.SentBytesTotal), key.Bucket, key.Owner, key.Category),
+			),
+			prometheus.NewMetricWithTimestamp(
+				scraped,
+				prometheus.MustNewConstMetric(c.hourlyReceivedBytes, prometheus.GaugeValue, float64(value.ReceivedBytesTotal), key.Bucket, key.Owner, key.Category),
+			),
+		)
+	}
+
+	return metrics
+}
+
+// scrapeUsage fetches the usage counters of every bucket category, and the usage of the most recent complete hour if enabled
+// If a state file is configured, the counters are kept monotonic across usage log trims and restarts, and the state is saved after every scrape
+func (c *operationsCollector) scrapeUsage(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions, now time.Time) (usageTotals, *hourlyUsage, error) {
+	// Scrapes of the previous config can still be running after a reload
+	c.usageMu.Lock()
+	defer c.usageMu.Unlock()
+
+	if c.usage == nil {
+		state, err := loadUsageState(opts.UsageStateFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.usage = state
+	}
 
-			combinedUsageStats := map[usageKey]usageValue{}
+	// The hours before the cutoff are over, and their entries are final
+	cutoff := now.Add(-usageSettleDelay).Truncate(time.Hour)
 
-			for _, entry := range usageStats.Entries {
-				owner := entry.User
-				for _, bucket := range entry.Buckets {
-					bucketName := bucket.ID
+	var hourly *hourlyUsage
+	if opts.Ops.Hourly {
+		hourly = &hourlyUsage{Hour: cutoff.Add(-time.Hour), Usage: usageTotals{}}
+	}
 
-					for _, category := range bucket.Categories {
-						key := usageKey{
-							Owner:    owner,
-							Bucket:   bucketName,
-							Category: category.Name,
-						}
+	var combinedUsageStats usageTotals
+	var err error
+	if opts.Ops.Summary {
+		combinedUsageStats, err = c.scrapeSummary(ctx, client, rgwURL, signer)
+	} else if opts.Ops.Incremental {
+		combinedUsageStats, err = c.scrapeIncremental(ctx, client, rgwURL, signer, cutoff, hourly)
+	} else {
+		combinedUsageStats, err = c.scrapeFull(ctx, client, rgwURL, signer, hourly)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-						currentValue := combinedUsageStats[key]
+	if opts.UsageStateFile == "" {
+		return combinedUsageStats, hourly, nil
+	}
 
-						currentValue.OpsTotal += category.Ops
-						currentValue.OpsSuccessful += category.SuccessfulOps
-						currentValue.SentBytesTotal += category.BytesSent
-						currentValue.ReceivedBytesTotal += category.BytesReceived
+	combinedUsageStats, trimmed, pruned := c.usage.keepMonotonic(combinedUsageStats, now, opts.StateRetention)
+	if trimmed > 0 {
+		log.Infof("The usage of %d bucket categories decreased. Assuming the usage log was trimmed", trimmed)
+	}
+	if pruned > 0 {
+		log.Infof("Dropped the baselines of %d bucket categories that were missing from the usage log for longer than %v", pruned, opts.StateRetention)
+	}
+
+	// The saved state stays consistent if this fails. It is just older
+	if err := c.usage.save(opts.UsageStateFile); err != nil {
+		log.Warnf("Failed to save the usage state - %v", err)
+	}
+
+	return combinedUsageStats, hourly, nil
+}
 
-						combinedUsageStats[key] = currentValue
-					}
-				}
+// scrapeSummary fetches the usage summary of each user
+// The usage of each user is keyed by its owner only, so it never collides with the usage of a bucket category in the state
+func (c *operationsCollector) scrapeSummary(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner) (usageTotals, error) {
+	combinedUsageStats := usageTotals{}
+
+	err := getCephUsageSummary(ctx, client, rgwURL, signer, func(entry usageSummaryEntry) error {
+		combinedUsageStats.add(usageKey{Owner: entry.User}, entry.Total)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return combinedUsageStats, nil
+}
+
+// scrapeFull sums the whole usage log
+// If `hourly` isn't nil, the usage of its hour is added to it
+func (c *operationsCollector) scrapeFull(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, hourly *hourlyUsage) (usageTotals, error) {
+	// Ceph will sometimes return duplicate entries with different counts
+	// We have to combine those before returning counters to Prometheus
+	combinedUsageStats := usageTotals{}
+
+	// The entries are combined as they are streamed from Ceph, so we never hold the whole usage log in memory
+	err := getCephUsageStats(ctx, client, rgwURL, signer, time.Time{}, func(entry usageEntry) error {
+		for _, bucket := range entry.Buckets {
+			hourly.add(entry.User, bucket)
+
+			for _, category := range bucket.Categories {
+				combinedUsageStats.add(usageKey{Owner: entry.User, Bucket: bucket.ID, Category: category.Name}, category)
 			}
+		}
 
-			// Now create the metrics from the combined usage stats
-			metrics := []prometheus.Metric{}
-			for key, value := range combinedUsageStats {
-				metrics = append(metrics,
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.opsTotal,
-							prometheus.CounterValue,
-							float64(value.OpsTotal),
-							key.Bucket, key.Owner, key.Category,
-						),
-					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.opsSuccessful,
-							prometheus.CounterValue,
-							float64(value.OpsSuccessful),
-							key.Bucket, key.Owner, key.Category,
-						),
-					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.sentBytesTotal,
-							prometheus.CounterValue,
-							float64(value.SentBytesTotal),
-							key.Bucket, key.Owner, key.Category,
-						),
-					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.receivedBytesTotal,
-							prometheus.CounterValue,
-							float64(value.ReceivedBytesTotal),
-							key.Bucket, key.Owner, key.Category,
-						),
-					),
-				)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return combinedUsageStats, nil
+}
+
+// scrapeIncremental only fetches the hours of the usage log that weren't accumulated yet
+// The usage of the hours that are over is added to the accumulated totals, and the watermark moves past them
+// The usage of the hours from the cutoff onwards is added on top of the totals, without being accumulated, until they are over
+// If `hourly` isn't nil, the usage of its hour is added to it, even if it was already accumulated
+func (c *operationsCollector) scrapeIncremental(ctx context.Context, client *http.Client, rgwURL *url.URL, signer *requestSigner, cutoff time.Time, hourly *hourlyUsage) (usageTotals, error) {
+	start := c.usage.Watermark
+	if hourly != nil && !start.IsZero() && hourly.Hour.Before(start) {
+		start = hourly.Hour
+	}
+
+	completed := usageTotals{}
+	current := usageTotals{}
+	err := getCephUsageStats(ctx, client, rgwURL, signer, start, func(entry usageEntry) error {
+		for _, bucket := range entry.Buckets {
+			hourly.add(entry.User, bucket)
+
+			epoch := time.Unix(bucket.Epoch, 0)
+			if epoch.Before(c.usage.Watermark) {
+				// Already accumulated
+				continue
 			}
 
-			// Update the metrics
-			c.Lock()
-			c.metrics = metrics
-			c.Unlock()
-		}()
+			totals := current
+			if epoch.Before(cutoff) {
+				totals = completed
+			}
 
-		// Wait for the next tick event or ctx cancel
-		select {
-		case <-ticker.C:
-			// Loop
-		case <-ctx.Done():
-			return
+			for _, category := range bucket.Categories {
+				totals.add(usageKey{Owner: entry.User, Bucket: bucket.ID, Category: category.Name}, category)
+			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	if cutoff.After(c.usage.Watermark) {
+		c.usage.Totals.merge(completed)
+		c.usage.Watermark = cutoff
+	}
+
+	combinedUsageStats := usageTotals{}
+	combinedUsageStats.merge(c.usage.Totals)
+	combinedUsageStats.merge(current)
+
+	return combinedUsageStats, nil
 }
 
 type bucketsCollector struct {
-	sync.Mutex
-	metrics []prometheus.Metric
+	cache metricsCache
 
 	bucketUsedBytes           *prometheus.Desc
 	bucketUtilizedBytes       *prometheus.Desc
@@ -278,14 +952,13 @@ type bucketsCollector struct {
 	bucketQuotaMaxSizeBytes   *prometheus.Desc
 	bucketQuotaMaxObjectCount *prometheus.Desc
 
-	scrapeDurationSeconds *prometheus.GaugeVec
-	scrapeCountTotal      *prometheus.CounterVec
+	scrapeDurationSeconds       *prometheus.GaugeVec
+	scrapeCountTotal            *prometheus.CounterVec
+	lastSuccessTimestampSeconds *prometheus.GaugeVec
 }
 
-func newBucketsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec) *bucketsCollector {
+func newBucketsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec, lastSuccessTimestampSeconds *prometheus.GaugeVec) *bucketsCollector {
 	return &bucketsCollector{
-		metrics: []prometheus.Metric{},
-
 		bucketUsedBytes: prometheus.NewDesc(
 			"radosgw_usage_bucket_bytes",
 			"Bucket used bytes",
@@ -329,8 +1002,9 @@ func newBucketsCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCount
 			prometheus.Labels{},
 		),
 
-		scrapeDurationSeconds: scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "buckets"}),
-		scrapeCountTotal:      scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "buckets"}),
+		scrapeDurationSeconds:       scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "buckets"}),
+		scrapeCountTotal:            scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "buckets"}),
+		lastSuccessTimestampSeconds: lastSuccessTimestampSeconds.MustCurryWith(prometheus.Labels{"type": "buckets"}),
 	}
 }
 
@@ -345,17 +1019,17 @@ func (c *bucketsCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (c *bucketsCollector) Collect(ch chan<- prometheus.Metric) {
-	c.Lock()
-	defer c.Unlock()
-
-	for _, metric := range c.metrics {
-		ch <- metric
-	}
+	c.cache.collect(ch)
 }
 
 // FetchMetrics will fetch bucket metrics from Ceph in an infinite loop until ctx is cancelled
-// It uses a Ticker to attempt to fetch from Ceph every `interval` time period
-func (c *bucketsCollector) FetchMetrics(ctx context.Context, log *logrus.Logger, client *http.Client, rgwURL *url.URL, creds *credentials.Credentials, interval time.Duration) {
+// It uses a Ticker to attempt to fetch from Ceph every `opts.Interval` time period, unless the collector has its own interval
+func (c *bucketsCollector) FetchMetrics(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) {
+	interval := opts.Buckets.interval(opts.Interval)
+	if !waitStartupDelay(ctx, opts.StartupJitter, interval) {
+		return
+	}
+
 	ticker := time.NewTicker(interval)
 
 	for {
@@ -363,135 +1037,173 @@ func (c *bucketsCollector) FetchMetrics(ctx context.Context, log *logrus.Logger,
 			return
 		}
 
-		func() {
-			start := time.Now()
+		// Scrape logs and counts its own failures, so there is nothing left to do with the error here
+		_ = c.Scrape(ctx, log, client, rgwURL, signer, opts)
+
+		// Wait for the next tick event or ctx cancel
+		select {
+		case <-ticker.C:
+			// Loop
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			bucketStats, err := getCephBucketStats(client, rgwURL, creds)
+// Scrape fetches the bucket metrics from Ceph once, and updates the collected metrics if it succeeds
+func (c *bucketsCollector) Scrape(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) error {
+	start := time.Now()
 
-			c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
+	scrapeCtx, cancel := scrapeContext(ctx, opts.Timeout)
+	defer cancel()
 
-			if err != nil {
-				c.scrapeCountTotal.With(prometheus.Labels{"status": "error"}).Inc()
-				log.Errorf("Failed to scrape Ceph usage stats - %v", err)
-				return
-			}
+	// The metrics are built as the buckets are streamed from Ceph, so we never hold the whole bucket list in memory
+	metrics := []prometheus.Metric{}
+	err := getCephBucketStats(scrapeCtx, client, rgwURL, signer, opts.UserFilter, opts.PageSize, opts.UserConcurrency, func(bucketInfo bucketInfoEntry) {
+		if !opts.BucketFilter.Keep(bucketInfo.Name) || !opts.UserFilter.Keep(bucketInfo.Owner) {
+			return
+		}
 
-			c.scrapeCountTotal.With(prometheus.Labels{"status": "success"}).Inc()
-
-			metrics := []prometheus.Metric{}
-			for _, bucketInfo := range bucketStats {
-				metrics = append(metrics,
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.bucketShardCount,
-							prometheus.GaugeValue,
-							float64(bucketInfo.NumShards),
-							bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-						),
-					),
-				)
-
-				if usage, ok := bucketInfo.Usage["rgw.main"]; ok {
-					metrics = append(metrics,
-						prometheus.NewMetricWithTimestamp(
-							start,
-							prometheus.MustNewConstMetric(
-								c.bucketUsedBytes,
-								prometheus.GaugeValue,
-								float64(usage.Size),
-								bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-							),
-						),
-						prometheus.NewMetricWithTimestamp(
-							start,
-							prometheus.MustNewConstMetric(
-								c.bucketUtilizedBytes,
-								prometheus.GaugeValue,
-								float64(usage.UtilizedSize),
-								bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-							),
-						),
-						prometheus.NewMetricWithTimestamp(
-							start,
-							prometheus.MustNewConstMetric(
-								c.bucketObjectCount,
-								prometheus.GaugeValue,
-								float64(usage.NumObjects),
-								bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-							),
-						),
-					)
-				}
-
-				bucketQuotaEnabled := 1.0
-				if !bucketInfo.Quota.Enabled {
-					bucketQuotaEnabled = 0.0
-				}
-
-				metrics = append(metrics,
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.bucketQuotaEnabled,
-							prometheus.GaugeValue,
-							bucketQuotaEnabled,
-							bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-						),
+		metrics = append(metrics,
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.bucketShardCount,
+					prometheus.GaugeValue,
+					float64(bucketInfo.NumShards),
+					bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
+				),
+			),
+		)
+
+		if usage, ok := bucketInfo.Usage["rgw.main"]; ok {
+			metrics = append(metrics,
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.bucketUsedBytes,
+						prometheus.GaugeValue,
+						float64(usage.Size),
+						bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
 					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.bucketQuotaMaxSizeBytes,
-							prometheus.GaugeValue,
-							float64(bucketInfo.Quota.MaxSize),
-							bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-						),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.bucketUtilizedBytes,
+						prometheus.GaugeValue,
+						float64(usage.UtilizedSize),
+						bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
 					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.bucketQuotaMaxObjectCount,
-							prometheus.GaugeValue,
-							float64(bucketInfo.Quota.MaxObjects),
-							bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
-						),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.bucketObjectCount,
+						prometheus.GaugeValue,
+						float64(usage.NumObjects),
+						bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
 					),
-				)
-			}
-
-			// Update the metrics
-			c.Lock()
-			c.metrics = metrics
-			c.Unlock()
-		}()
+				),
+			)
+		}
 
-		// Wait for the next tick event or ctx cancel
-		select {
-		case <-ticker.C:
-			// Loop
-		case <-ctx.Done():
-			return
+		bucketQuotaEnabled := 1.0
+		if !bucketInfo.Quota.Enabled {
+			bucketQuotaEnabled = 0.0
 		}
+
+		metrics = append(metrics,
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.bucketQuotaEnabled,
+					prometheus.GaugeValue,
+					bucketQuotaEnabled,
+					bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.bucketQuotaMaxSizeBytes,
+					prometheus.GaugeValue,
+					float64(bucketInfo.Quota.MaxSize),
+					bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.bucketQuotaMaxObjectCount,
+					prometheus.GaugeValue,
+					float64(bucketInfo.Quota.MaxObjects),
+					bucketInfo.Name, bucketInfo.Owner, bucketInfo.ZoneGroup,
+				),
+			),
+		)
+	})
+
+	c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
+
+	if err != nil && ctx.Err() != nil {
+		// We're shutting down, so this isn't a real scrape failure
+		return err
+	}
+
+	c.scrapeCountTotal.With(prometheus.Labels{"status": scrapeStatus(err)}).Inc()
+
+	if err != nil {
+		log.Errorf("Failed to scrape Ceph bucket stats - %v", err)
+		c.cache.fail(err)
+		return err
+	}
+
+	// Update the metrics
+	if c.cache.update(metrics, start, opts.MaxStaleness) {
+		c.lastSuccessTimestampSeconds.WithLabelValues().Set(float64(start.Unix()))
 	}
+
+	return nil
 }
 
 type userInfoCollector struct {
-	sync.Mutex
-	metrics []prometheus.Metric
+	cache metricsCache
 
+	userUsedBytes         *prometheus.Desc
+	userUtilizedBytes     *prometheus.Desc
+	userObjectCount       *prometheus.Desc
 	userQuotaEnabled      *prometheus.Desc
 	userQuotaMaxSizeBytes *prometheus.Desc
 	userQuotaMaxObjects   *prometheus.Desc
 
-	scrapeDurationSeconds *prometheus.GaugeVec
-	scrapeCountTotal      *prometheus.CounterVec
+	fetchErrorsTotal *prometheus.CounterVec
+
+	scrapeDurationSeconds       *prometheus.GaugeVec
+	scrapeCountTotal            *prometheus.CounterVec
+	lastSuccessTimestampSeconds *prometheus.GaugeVec
 }
 
-func newUserInfoCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec) *userInfoCollector {
+func newUserInfoCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCountTotal *prometheus.CounterVec, lastSuccessTimestampSeconds *prometheus.GaugeVec) *userInfoCollector {
 	return &userInfoCollector{
-		metrics: []prometheus.Metric{},
-
+		userUsedBytes: prometheus.NewDesc(
+			"radosgw_usage_user_bytes",
+			"User used bytes",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+		userUtilizedBytes: prometheus.NewDesc(
+			"radosgw_usage_user_utilized_bytes",
+			"User utilized bytes",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
+		userObjectCount: prometheus.NewDesc(
+			"radosgw_usage_user_objects",
+			"Number of objects owned by the user",
+			[]string{"user"},
+			prometheus.Labels{},
+		),
 		userQuotaEnabled: prometheus.NewDesc(
 			"radosgw_usage_user_quota_enabled",
 			"Whether a quota is enabled for the user",
@@ -511,29 +1223,44 @@ func newUserInfoCollector(scrapeDurationSeconds *prometheus.GaugeVec, scrapeCoun
 			prometheus.Labels{},
 		),
 
-		scrapeDurationSeconds: scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "users"}),
-		scrapeCountTotal:      scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "users"}),
+		fetchErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "radosgw_usage",
+				Name:      "user_fetch_errors_total",
+				Help:      "Number of users whose info could not be fetched during a scrape",
+			},
+			[]string{"reason"},
+		),
+
+		scrapeDurationSeconds:       scrapeDurationSeconds.MustCurryWith(prometheus.Labels{"type": "users"}),
+		scrapeCountTotal:            scrapeCountTotal.MustCurryWith(prometheus.Labels{"type": "users"}),
+		lastSuccessTimestampSeconds: lastSuccessTimestampSeconds.MustCurryWith(prometheus.Labels{"type": "users"}),
 	}
 }
 
 func (c *userInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.userUsedBytes
+	ch <- c.userUtilizedBytes
+	ch <- c.userObjectCount
 	ch <- c.userQuotaEnabled
 	ch <- c.userQuotaMaxSizeBytes
 	ch <- c.userQuotaMaxObjects
+	c.fetchErrorsTotal.Describe(ch)
 }
 
 func (c *userInfoCollector) Collect(ch chan<- prometheus.Metric) {
-	c.Lock()
-	defer c.Unlock()
-
-	for _, metric := range c.metrics {
-		ch <- metric
-	}
+	c.cache.collect(ch)
+	c.fetchErrorsTotal.Collect(ch)
 }
 
 // FetchMetrics will fetch user info metrics from Ceph in an infinite loop until ctx is cancelled
-// It uses a Ticker to attempt to fetch from Ceph every `interval` time period
-func (c *userInfoCollector) FetchMetrics(ctx context.Context, log *logrus.Logger, client *http.Client, rgwURL *url.URL, creds *credentials.Credentials, interval time.Duration) {
+// It uses a Ticker to attempt to fetch from Ceph every `opts.Interval` time period, unless the collector has its own interval
+func (c *userInfoCollector) FetchMetrics(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) {
+	interval := opts.Users.interval(opts.Interval)
+	if !waitStartupDelay(ctx, opts.StartupJitter, interval) {
+		return
+	}
+
 	ticker := time.NewTicker(interval)
 
 	for {
@@ -541,71 +1268,154 @@ func (c *userInfoCollector) FetchMetrics(ctx context.Context, log *logrus.Logger
 			return
 		}
 
-		func() {
-			start := time.Now()
+		// Scrape logs and counts its own failures, so there is nothing left to do with the error here
+		_ = c.Scrape(ctx, log, client, rgwURL, signer, opts)
+
+		// Wait for the next tick event or ctx cancel
+		select {
+		case <-ticker.C:
+			// Loop
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Scrape fetches the user info metrics from Ceph once, and updates the collected metrics if it succeeds
+func (c *userInfoCollector) Scrape(ctx context.Context, log logrus.FieldLogger, client *http.Client, rgwURL *url.URL, signer *requestSigner, opts ScrapeOptions) error {
+	start := time.Now()
+
+	scrapeCtx, cancel := scrapeContext(ctx, opts.Timeout)
+	defer cancel()
 
-			userQuotaInfo, err := getCephUserQuotaStats(client, rgwURL, creds)
+	userInfo, failures, err := getCephUserQuotaStats(scrapeCtx, client, rgwURL, signer, opts.UserFilter, opts.SyncUserStats, opts.PageSize, opts.UserConcurrency)
 
-			c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
+	c.scrapeDurationSeconds.WithLabelValues().Set(time.Since(start).Seconds())
+
+	if err != nil && ctx.Err() != nil {
+		// We're shutting down, so this isn't a real scrape failure
+		return err
+	}
 
-			if err != nil {
-				c.scrapeCountTotal.With(prometheus.Labels{"status": "error"}).Inc()
-				log.Errorf("Failed to scrape Ceph usage stats - %v", err)
-				return
+	if err != nil {
+		c.scrapeCountTotal.With(prometheus.Labels{"status": scrapeStatus(err)}).Inc()
+		log.Errorf("Failed to scrape Ceph user stats - %v", err)
+		c.cache.fail(err)
+		return err
+	}
+
+	// Failing to fetch a single user doesn't fail the whole scrape
+	// Users that vanished since the user list was fetched are expected, so they don't degrade the scrape
+	status := "success"
+	failed := userFetchErrors{}
+	for user, fetchErr := range failures {
+		reason := userFetchErrorReason(fetchErr)
+		c.fetchErrorsTotal.With(prometheus.Labels{"reason": reason}).Inc()
+
+		if reason == userFetchReasonNotFound {
+			log.Debugf("Skipping user `%s` that no longer exists", user)
+			continue
+		}
+
+		status = "partial"
+		failed[user] = fetchErr
+		log.Warnf("Failed to fetch Ceph user `%s` - %v", user, fetchErr)
+	}
+
+	// If no user could be fetched, RGW is most likely failing, so the scrape fails instead of dropping all the users
+	if len(userInfo) == 0 && len(failed) > 0 {
+		status = "timeout"
+		for _, fetchErr := range failed {
+			if !isTimeoutError(fetchErr) {
+				status = "error"
 			}
+		}
+
+		err := fmt.Errorf("failed to fetch all of the %d users - %w", len(failed), failed)
+		c.scrapeCountTotal.With(prometheus.Labels{"status": status}).Inc()
+		log.Errorf("Failed to scrape Ceph user stats - %v", err)
+		c.cache.fail(err)
+		return err
+	}
 
-			c.scrapeCountTotal.With(prometheus.Labels{"status": "success"}).Inc()
-
-			metrics := []prometheus.Metric{}
-			for userName, quotaInfo := range userQuotaInfo {
-				userQuotaEnabled := 1.0
-				if !quotaInfo.Enabled {
-					userQuotaEnabled = 0.0
-				}
-
-				metrics = append(metrics,
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.userQuotaEnabled,
-							prometheus.GaugeValue,
-							userQuotaEnabled,
-							userName,
-						),
+	c.scrapeCountTotal.With(prometheus.Labels{"status": status}).Inc()
+
+	metrics := []prometheus.Metric{}
+	for userName, info := range userInfo {
+		if info.Stats != nil {
+			metrics = append(metrics,
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.userUsedBytes,
+						prometheus.GaugeValue,
+						float64(info.Stats.Size),
+						userName,
 					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.userQuotaMaxSizeBytes,
-							prometheus.GaugeValue,
-							float64(quotaInfo.MaxSize),
-							userName,
-						),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.userUtilizedBytes,
+						prometheus.GaugeValue,
+						float64(info.Stats.UtilizedSize),
+						userName,
 					),
-					prometheus.NewMetricWithTimestamp(
-						start,
-						prometheus.MustNewConstMetric(
-							c.userQuotaMaxObjects,
-							prometheus.GaugeValue,
-							float64(quotaInfo.MaxObjects),
-							userName,
-						),
+				),
+				prometheus.NewMetricWithTimestamp(
+					start,
+					prometheus.MustNewConstMetric(
+						c.userObjectCount,
+						prometheus.GaugeValue,
+						float64(info.Stats.NumObjects),
+						userName,
 					),
-				)
-			}
+				),
+			)
+		}
 
-			// Update the metrics
-			c.Lock()
-			c.metrics = metrics
-			c.Unlock()
-		}()
+		quotaInfo := info.Quota
 
-		// Wait for the next tick event or ctx cancel
-		select {
-		case <-ticker.C:
-			// Loop
-		case <-ctx.Done():
-			return
+		userQuotaEnabled := 1.0
+		if !quotaInfo.Enabled {
+			userQuotaEnabled = 0.0
 		}
+
+		metrics = append(metrics,
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.userQuotaEnabled,
+					prometheus.GaugeValue,
+					userQuotaEnabled,
+					userName,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.userQuotaMaxSizeBytes,
+					prometheus.GaugeValue,
+					float64(quotaInfo.MaxSize),
+					userName,
+				),
+			),
+			prometheus.NewMetricWithTimestamp(
+				start,
+				prometheus.MustNewConstMetric(
+					c.userQuotaMaxObjects,
+					prometheus.GaugeValue,
+					float64(quotaInfo.MaxObjects),
+					userName,
+				),
+			),
+		)
 	}
+
+	// Update the metrics
+	if c.cache.update(metrics, start, opts.MaxStaleness) {
+		c.lastSuccessTimestampSeconds.WithLabelValues().Set(float64(start.Unix()))
+	}
+
+	return nil
 }
@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	var failing int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, `{"entries": [{"user": "alice", "buckets": [{"bucket": "photos", "categories": [{"category": "get_obj", "ops": 1}]}]}]}`)
+	})
+
+	registry := prometheus.NewRegistry()
+	metrics := NewRGWMetrics(registry)
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{MaxStaleness: time.Hour}
+
+	start := time.Now().Unix()
+	require.NoError(t, metrics.ops.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+
+	lastSuccess := testutil.ToFloat64(metrics.lastSuccessTimestampSeconds.WithLabelValues("ops"))
+	require.GreaterOrEqual(t, lastSuccess, float64(start))
+	require.Equal(t, 4, testutil.CollectAndCount(metrics.ops))
+
+	// A failed scrape keeps the last metrics, and doesn't move the timestamp
+	atomic.StoreInt32(&failing, 1)
+	require.Error(t, metrics.ops.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+	require.Equal(t, lastSuccess, testutil.ToFloat64(metrics.lastSuccessTimestampSeconds.WithLabelValues("ops")))
+	require.Equal(t, 4, testutil.CollectAndCount(metrics.ops))
+}
+
+func TestScrapeTimeoutStatus(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		// Answer after the request timeout
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+
+		fmt.Fprint(w, `{"entries": []}`)
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	client := makeHTTPClient(50*time.Millisecond, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	err := metrics.ops.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, ScrapeOptions{})
+	require.Error(t, err)
+	require.True(t, isTimeoutError(err))
+
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.scrapeCountTotal.WithLabelValues("ops", "timeout")))
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.scrapeCountTotal.WithLabelValues("ops", "error")))
+}
+
+func TestUserStats(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/user_info.json")
+	require.NoError(t, err)
+
+	for _, syncStats := range []bool{false, true} {
+		rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if query.Has("list") {
+				require.NoError(t, json.NewEncoder(w).Encode(userListResponse{Keys: []string{"alice"}}))
+				return
+			}
+
+			require.Equal(t, "/admin/user", r.URL.Path)
+			require.Equal(t, "alice", query.Get("uid"))
+			require.Equal(t, "True", query.Get("stats"))
+			if syncStats {
+				require.Equal(t, "True", query.Get("sync"))
+			} else {
+				require.False(t, query.Has("sync"))
+			}
+
+			_, err := w.Write(fixture)
+			require.NoError(t, err)
+		})
+
+		registry := prometheus.NewRegistry()
+		metrics := NewRGWMetrics(registry)
+		client := makeHTTPClient(time.Minute, nil)
+		signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+		opts := ScrapeOptions{SyncUserStats: syncStats}
+
+		require.NoError(t, metrics.userInfo.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				if len(metric.GetLabel()) != 1 || metric.GetLabel()[0].GetName() != "user" {
+					continue
+				}
+
+				require.Equal(t, "alice", metric.GetLabel()[0].GetValue())
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+
+		require.Equal(t, map[string]float64{
+			"radosgw_usage_user_bytes":              52432896,
+			"radosgw_usage_user_utilized_bytes":     52428800,
+			"radosgw_usage_user_objects":            42,
+			"radosgw_usage_user_quota_enabled":      1,
+			"radosgw_usage_user_quota_size_bytes":   1073741824,
+			"radosgw_usage_user_quota_size_objects": 1000,
+		}, values)
+	}
+}
+
+func TestUserStatsAllUsersFail(t *testing.T) {
+	var failing int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Has("list") {
+			require.NoError(t, json.NewEncoder(w).Encode(userListResponse{Keys: []string{"alice", "bob"}}))
+			return
+		}
+
+		uid := query.Get("uid")
+		if atomic.LoadInt32(&failing) == 1 {
+			// A deleted user doesn't make up for the others failing
+			if uid == "alice" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, `{"user_id": %q, "stats": {"size_actual": 1, "size_utilized": 1, "num_objects": 1}}`, uid)
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{UserConcurrency: 2}
+
+	require.NoError(t, metrics.userInfo.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+	count := testutil.CollectAndCount(metrics.userInfo, "radosgw_usage_user_bytes")
+	require.Equal(t, 2, count)
+	lastSuccess := testutil.ToFloat64(metrics.lastSuccessTimestampSeconds.WithLabelValues("users"))
+	state := metrics.userInfo.cache.state("users", false)
+
+	// The scrape fails, and the previous metrics are kept
+	atomic.StoreInt32(&failing, 1)
+	require.Error(t, metrics.userInfo.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+	require.Equal(t, count, testutil.CollectAndCount(metrics.userInfo, "radosgw_usage_user_bytes"))
+	require.Equal(t, lastSuccess, testutil.ToFloat64(metrics.lastSuccessTimestampSeconds.WithLabelValues("users")))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.scrapeCountTotal.WithLabelValues("users", "error")))
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.scrapeCountTotal.WithLabelValues("users", "partial")))
+	require.Equal(t, state.lastSuccess, metrics.userInfo.cache.state("users", false).lastSuccess)
+	require.Error(t, metrics.userInfo.cache.state("users", false).lastErr)
+}
+
+func TestMetricsCacheStaleness(t *testing.T) {
+	desc := prometheus.NewDesc("test_metric", "Test metric", nil, nil)
+	metrics := []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)}
+
+	collect := func(cache *metricsCache) int {
+		ch := make(chan prometheus.Metric, len(metrics))
+		cache.collect(ch)
+		close(ch)
+
+		return len(ch)
+	}
+
+	cache := &metricsCache{}
+	cache.update(metrics, time.Now().Add(-time.Hour), time.Minute)
+	require.Equal(t, 0, collect(cache))
+
+	cache.update(metrics, time.Now(), time.Minute)
+	require.Equal(t, 1, collect(cache))
+
+	// Without a max staleness, the metrics are always collected
+	cache.update(metrics, time.Now().Add(-time.Hour), 0)
+	require.Equal(t, 1, collect(cache))
+}
+
+func TestOnDemandScraping(t *testing.T) {
+	var requests int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// Slow enough for the concurrent collections to overlap
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"entries": [{"user": "alice", "buckets": [{"bucket": "photos", "categories": [{"category": "get_obj", "ops": 1}]}]}]}`)
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{
+		Interval: time.Hour,
+		Ops:      CollectorOptions{Enabled: true, OnDemand: true, CacheTTL: time.Hour},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	metrics.StartScraping(ctx, logrus.New(), client, rgwURL, signer, opts)
+
+	// Nothing is scraped until the metrics are collected
+	require.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	// Concurrent collections share a single scrape
+	counts := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			counts[i] = testutil.CollectAndCount(metrics.ops)
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, []int{4, 4, 4, 4, 4}, counts)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Collections within the cache TTL return the cached metrics
+	require.Equal(t, 4, testutil.CollectAndCount(metrics.ops))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	opts.Ops.CacheTTL = 0
+	metrics.StartScraping(ctx, logrus.New(), client, rgwURL, signer, opts)
+	require.Equal(t, 4, testutil.CollectAndCount(metrics.ops))
+	require.Equal(t, 4, testutil.CollectAndCount(metrics.ops))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestOnDemandScrapingTimeout(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the exporter gives up
+		<-r.Context().Done()
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{
+		Interval: time.Hour,
+		Timeout:  100 * time.Millisecond,
+		Ops:      CollectorOptions{Enabled: true, OnDemand: true},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	metrics.StartScraping(ctx, logrus.New(), client, rgwURL, signer, opts)
+
+	// The collection doesn't wait for RGW past the scrape timeout
+	start := time.Now()
+	require.Equal(t, 0, testutil.CollectAndCount(metrics.ops))
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.scrapeCountTotal.WithLabelValues("ops", "timeout")))
+}
+
+func TestWaitStartupDelay(t *testing.T) {
+	require.True(t, waitStartupDelay(context.Background(), 0, time.Minute))
+	require.True(t, waitStartupDelay(context.Background(), time.Hour, time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.False(t, waitStartupDelay(ctx, time.Hour, time.Hour))
+}
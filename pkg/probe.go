@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProbeModule = "default"
+
+	// defaultPrometheusScrapeTimeout is the scrape timeout of Prometheus if the scrape config doesn't set one
+	defaultPrometheusScrapeTimeout = 10 * time.Second
+	// scrapeTimeoutOffset is subtracted from the Prometheus scrape timeout, to leave time to send the response
+	scrapeTimeoutOffset = 500 * time.Millisecond
+)
+
+// probeHandler scrapes the RGW instance given by the `target` query parameter synchronously, using the
+// credentials of the module given by the `module` query parameter, and responds with the resulting metrics
+// Only the targets listed by the module can be probed
+// `modules` is called on each request, so the modules can be reloaded
+func probeHandler(log *logrus.Logger, modules func() map[string]*probeModule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		moduleName := query.Get("module")
+		if moduleName == "" {
+			moduleName = defaultProbeModule
+		}
+
+		module, ok := modules()[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module `%s`", moduleName), http.StatusBadRequest)
+			return
+		}
+
+		target := query.Get("target")
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		rgwURL, err := parseProbeTarget(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Check the target before anything is signed with the module's credentials
+		if !module.allows(rgwURL) {
+			http.Error(w, fmt.Sprintf("Target `%s` is not in the targets of module `%s`", target, moduleName), http.StatusBadRequest)
+			return
+		}
+
+		opts := module.opts
+		if timeout, ok := prometheusScrapeTimeout(r); ok && (opts.Timeout <= 0 || timeout < opts.Timeout) {
+			opts.Timeout = timeout
+		}
+
+		registry := prometheus.NewRegistry()
+		var registerer prometheus.Registerer = registry
+		if len(module.labels) > 0 {
+			registerer = prometheus.WrapRegistererWith(module.labels, registry)
+		}
+		metrics := NewRGWMetrics(registerer)
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "radosgw_usage",
+			Name:      "probe_success",
+			Help:      "Whether all the scrapes of the probe succeeded",
+		})
+		probeDurationSeconds := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "radosgw_usage",
+			Name:      "probe_duration_seconds",
+			Help:      "Amount of time the probe took",
+		})
+		registry.MustRegister(probeSuccess, probeDurationSeconds)
+
+		start := time.Now()
+		err = metrics.Scrape(r.Context(), log.WithField("target", target), metrics.InstrumentClient(module.client), rgwURL, module.signer, opts)
+		probeDurationSeconds.Set(time.Since(start).Seconds())
+
+		if err != nil {
+			log.Debugf("Probe of `%s` with module `%s` failed - %v", target, moduleName, err)
+		} else {
+			probeSuccess.Set(1)
+		}
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// parseProbeTarget parses the URL of an RGW instance to probe
+func parseProbeTarget(target string) (*url.URL, error) {
+	rgwURL, err := url.Parse(target)
+	if err != nil || (rgwURL.Scheme != "http" && rgwURL.Scheme != "https") || rgwURL.Host == "" {
+		return nil, fmt.Errorf("target `%s` is not a valid http(s) URL", target)
+	}
+
+	return rgwURL, nil
+}
+
+// prometheusScrapeTimeout returns the scrape timeout Prometheus sends with each scrape, if any
+func prometheusScrapeTimeout(r *http.Request) (time.Duration, bool) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - scrapeTimeoutOffset
+	if timeout <= 0 {
+		return 0, false
+	}
+
+	return timeout, true
+}
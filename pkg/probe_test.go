@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeHandler(t *testing.T) {
+	var requests int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch r.URL.Path {
+		case "/admin/usage":
+			fmt.Fprint(w, `{"entries": []}`)
+		case "/admin/bucket":
+			fmt.Fprint(w, `[{"bucket": "photos", "owner": "alice", "num_shards": 11}]`)
+		case "/admin/user":
+			fmt.Fprint(w, `{"keys": []}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	modules := map[string]*probeModule{
+		defaultProbeModule: {
+			targets: []*url.URL{rgwURL},
+			client:  makeHTTPClient(time.Minute, nil),
+			signer:  newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4),
+			opts: ScrapeOptions{
+				UserConcurrency: 1,
+				Ops:             CollectorOptions{Enabled: true},
+				Buckets:         CollectorOptions{Enabled: true},
+				Users:           CollectorOptions{Enabled: true},
+			},
+		},
+	}
+	handler := probeHandler(logrus.New(), func() map[string]*probeModule { return modules })
+
+	probe := func(query url.Values) (int, string) {
+		req := httptest.NewRequest("GET", "/probe?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return rec.Code, string(body)
+	}
+
+	code, body := probe(url.Values{"target": {rgwURL.String()}})
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, "radosgw_usage_probe_success 1")
+	require.Contains(t, body, `radosgw_usage_bucket_shards{bucket="photos",owner="alice",zonegroup=""} 11`)
+
+	code, _ = probe(url.Values{"target": {rgwURL.String()}, "module": {"missing"}})
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = probe(url.Values{})
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Targets that aren't listed by the module are rejected before anything is sent to them
+	requestsBefore := atomic.LoadInt32(&requests)
+	otherURL := *rgwURL
+	otherURL.Host = "other.example.com"
+	code, _ = probe(url.Values{"target": {otherURL.String()}})
+	require.Equal(t, http.StatusBadRequest, code)
+
+	otherURL = *rgwURL
+	otherURL.Path = "/other/"
+	code, _ = probe(url.Values{"target": {otherURL.String()}})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, requestsBefore, atomic.LoadInt32(&requests))
+
+	// The trailing slash doesn't matter
+	code, _ = probe(url.Values{"target": {strings.TrimSuffix(rgwURL.String(), "/")}})
+	require.Equal(t, http.StatusOK, code)
+}
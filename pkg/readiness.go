@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// readinessConfig controls what /readiness checks, on top of the RGW health check
+type readinessConfig struct {
+	// RequireScrapes makes the exporter ready only once every enabled collector of every target had a successful scrape
+	// On demand collectors are exempt, since they are only scraped when Prometheus scrapes the exporter
+	RequireScrapes bool
+	// MaxScrapeAge is how old the last successful scrape may be for the collector to be ready. Zero means any age
+	MaxScrapeAge time.Duration
+}
+
+// readinessResponse is the JSON body returned by /readiness
+type readinessResponse struct {
+	Ready   bool                    `json:"ready"`
+	Targets []targetReadinessStatus `json:"targets"`
+}
+
+type targetReadinessStatus struct {
+	// Name is empty if only a single target is configured via ENV
+	Name        string `json:"name"`
+	Ready       bool   `json:"ready"`
+	HealthCheck string `json:"healthcheck"`
+	// Collectors only lists the enabled collectors
+	Collectors []collectorReadinessStatus `json:"collectors"`
+}
+
+type collectorReadinessStatus struct {
+	Type     string `json:"type"`
+	Ready    bool   `json:"ready"`
+	OnDemand bool   `json:"on_demand"`
+	// LastSuccess is nil until the collector has a successful scrape
+	LastSuccess *time.Time `json:"last_success"`
+	// LastError is the error of the last scrape, if it failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+// checkReadiness checks the health of every target, and the state of their collectors
+func checkReadiness(ctx context.Context, targets []*runningTarget, cfg readinessConfig, now time.Time) readinessResponse {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+
+	resp := readinessResponse{
+		Ready:   true,
+		Targets: []targetReadinessStatus{},
+	}
+	for _, target := range targets {
+		status := targetReadinessStatus{
+			Name:        target.name,
+			Ready:       true,
+			HealthCheck: "ok",
+			Collectors:  []collectorReadinessStatus{},
+		}
+
+		if err := cephHealthCheck(ctx, target.client, target.rgwURL); err != nil {
+			status.Ready = false
+			status.HealthCheck = err.Error()
+		}
+
+		for _, state := range target.metrics.collectorStates(target.opts) {
+			collector := collectorReadinessStatus{
+				Type:     state.collectorType,
+				Ready:    true,
+				OnDemand: state.onDemand,
+			}
+			if !state.lastSuccess.IsZero() {
+				lastSuccess := state.lastSuccess
+				collector.LastSuccess = &lastSuccess
+			}
+			if state.lastErr != nil {
+				collector.LastError = state.lastErr.Error()
+			}
+
+			if cfg.RequireScrapes && !state.onDemand {
+				collector.Ready = !state.lastSuccess.IsZero() && (cfg.MaxScrapeAge <= 0 || now.Sub(state.lastSuccess) <= cfg.MaxScrapeAge)
+			}
+
+			status.Ready = status.Ready && collector.Ready
+			status.Collectors = append(status.Collectors, collector)
+		}
+
+		resp.Ready = resp.Ready && status.Ready
+		resp.Targets = append(resp.Targets, status)
+	}
+
+	return resp
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/usage" {
+			fmt.Fprint(w, `{"entries": []}`)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	target := &runningTarget{
+		rgwTarget: &rgwTarget{
+			name:   "east",
+			client: makeHTTPClient(time.Minute, nil),
+			rgwURL: rgwURL,
+			signer: newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4),
+			opts:   ScrapeOptions{Ops: CollectorOptions{Enabled: true}},
+		},
+		metrics: NewRGWMetrics(prometheus.NewRegistry()),
+	}
+	targets := func() []*runningTarget { return []*runningTarget{target} }
+
+	// Only the health check is required by default
+	resp := checkReadiness(context.Background(), targets(), readinessConfig{}, time.Now())
+	require.True(t, resp.Ready)
+	require.Len(t, resp.Targets, 1)
+	require.Equal(t, "ok", resp.Targets[0].HealthCheck)
+	require.Len(t, resp.Targets[0].Collectors, 1)
+	require.Nil(t, resp.Targets[0].Collectors[0].LastSuccess)
+
+	cfg := readinessConfig{RequireScrapes: true, MaxScrapeAge: time.Minute}
+	resp = checkReadiness(context.Background(), targets(), cfg, time.Now())
+	require.False(t, resp.Ready)
+	require.False(t, resp.Targets[0].Collectors[0].Ready)
+
+	require.NoError(t, target.metrics.ops.Scrape(context.Background(), logrus.New(), target.client, target.rgwURL, target.signer, target.opts))
+	resp = checkReadiness(context.Background(), targets(), cfg, time.Now())
+	require.True(t, resp.Ready)
+	require.NotNil(t, resp.Targets[0].Collectors[0].LastSuccess)
+
+	// The last success is too old
+	resp = checkReadiness(context.Background(), targets(), cfg, time.Now().Add(time.Hour))
+	require.False(t, resp.Ready)
+
+	// On demand collectors are only scraped when Prometheus scrapes the exporter, so they don't block readiness
+	target.opts.Ops.OnDemand = true
+	resp = checkReadiness(context.Background(), targets(), cfg, time.Now().Add(time.Hour))
+	require.True(t, resp.Ready)
+	require.True(t, resp.Targets[0].Collectors[0].OnDemand)
+	target.opts.Ops.OnDemand = false
+
+	// The failures are reported in the JSON body
+	target.rgwURL = newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	require.Error(t, target.metrics.ops.Scrape(context.Background(), logrus.New(), target.client, target.rgwURL, target.signer, target.opts))
+
+	router := createRouter(logrus.New(), func(ctx context.Context) readinessResponse {
+		return checkReadiness(ctx, targets(), cfg, time.Now())
+	}, func() map[string]*probeModule { return nil }, prometheus.NewRegistry())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/readiness", nil))
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	body := readinessResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	require.False(t, body.Ready)
+	require.Equal(t, "east", body.Targets[0].Name)
+	require.Contains(t, body.Targets[0].HealthCheck, "403")
+	require.Equal(t, "ops", body.Targets[0].Collectors[0].Type)
+	require.True(t, body.Targets[0].Collectors[0].Ready)
+	require.Contains(t, body.Targets[0].Collectors[0].LastError, "403")
+}
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryOptions controls how failed admin API requests are retried
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of times a request is sent, including the first one. 1 disables retries
+	MaxAttempts int
+	// BackoffBase is the delay before the first retry. It doubles after every retry, up to BackoffCap
+	BackoffBase time.Duration
+	BackoffCap  time.Duration
+	// Jitter is the fraction of each delay that is randomized, between 0 and 1
+	// This keeps the retries of concurrent requests from hitting RGW at the same time
+	Jitter float64
+	// StatusCodes are the response status codes that are retried. Connection errors are always retried
+	StatusCodes []int
+}
+
+// backoff returns the delay before retry number `retry`, starting at 1
+func (o RetryOptions) backoff(retry int, random float64) time.Duration {
+	delay := o.BackoffBase
+	for i := 1; i < retry && delay < o.BackoffCap; i++ {
+		delay *= 2
+	}
+	if delay > o.BackoffCap {
+		delay = o.BackoffCap
+	}
+
+	return delay - time.Duration(float64(delay)*o.Jitter*random)
+}
+
+// retryableStatus returns true if a response with `statusCode` should be retried
+func (o RetryOptions) retryableStatus(statusCode int) bool {
+	for _, code := range o.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryTransport retries the admin API requests that fail with a connection error or a retryable status code
+// The requests must not have a body, which is always the case for the GET requests of the admin API
+type retryTransport struct {
+	next http.RoundTripper
+	opts RetryOptions
+	// timeout limits each attempt, including reading the response body. 0 means no limit
+	timeout time.Duration
+
+	retriesTotal *prometheus.CounterVec
+	// random returns a number in [0, 1). It is replaced in tests
+	random func() float64
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.roundTripAttempt(req)
+		if attempt >= t.opts.MaxAttempts || !t.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			// Drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		t.retriesTotal.WithLabelValues(adminEndpoint(req.URL)).Inc()
+
+		timer := time.NewTimer(t.opts.backoff(attempt, t.random()))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// roundTripAttempt sends `req` once, limited to the attempt timeout
+func (t *retryTransport) roundTripAttempt(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout also covers reading the body, so it is only released once the body is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryable returns true if the result of sending `req` is a transient failure
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Don't retry requests that were cancelled, or ran out of time
+		return req.Context().Err() == nil
+	}
+
+	return t.opts.retryableStatus(resp.StatusCode)
+}
+
+// withRetries returns a copy of `client` that retries failed requests according to `opts`
+// The timeout of `client` is applied to each attempt instead of to the whole request, so a slow attempt can still be retried
+func withRetries(client *http.Client, opts RetryOptions, retriesTotal *prometheus.CounterVec) *http.Client {
+	if opts.MaxAttempts <= 1 {
+		return client
+	}
+
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	retryClient := *client
+	retryClient.Timeout = 0
+	retryClient.Transport = &retryTransport{
+		next:         next,
+		opts:         opts,
+		timeout:      client.Timeout,
+		retriesTotal: retriesTotal,
+		random:       rand.Float64,
+	}
+
+	return &retryClient
+}
+
+// adminEndpoint returns the `endpoint` label value of a request to `u`. IE, `usage` for the admin/usage API
+func adminEndpoint(u *url.URL) string {
+	if i := strings.LastIndex(u.Path, "/admin/"); i >= 0 {
+		return strings.Trim(u.Path[i+len("/admin/"):], "/")
+	}
+
+	return "healthcheck"
+}
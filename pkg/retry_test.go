@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTransport(t *testing.T) {
+	var requests int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		// RGW is unavailable for the first two requests
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprint(w, `{"entries": [{"user": "alice"}]}`)
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	opts := RetryOptions{
+		MaxAttempts: 3,
+		BackoffBase: time.Millisecond,
+		BackoffCap:  10 * time.Millisecond,
+		Jitter:      0.5,
+		StatusCodes: []int{http.StatusServiceUnavailable},
+	}
+	client := withRetries(makeHTTPClient(time.Minute, nil), opts, metrics.adminAPI.retriesTotal)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	users := []string{}
+	err := getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error {
+		users = append(users, entry.User)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice"}, users)
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.adminAPI.retriesTotal.WithLabelValues("usage")))
+
+	// The last failure is returned once all the attempts are used
+	atomic.StoreInt32(&requests, -10)
+	err = getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error { return nil })
+	require.Error(t, err)
+	require.Equal(t, int32(-7), atomic.LoadInt32(&requests))
+	require.Equal(t, 4.0, testutil.ToFloat64(metrics.adminAPI.retriesTotal.WithLabelValues("usage")))
+
+	// Other status codes are not retried
+	opts.StatusCodes = []int{http.StatusTooManyRequests}
+	client = withRetries(makeHTTPClient(time.Minute, nil), opts, metrics.adminAPI.retriesTotal)
+	atomic.StoreInt32(&requests, 0)
+	_, err = getCephUserInfo(context.Background(), client, rgwURL, signer, "alice", false)
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.adminAPI.retriesTotal.WithLabelValues("user")))
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	var requests int32
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		// The first request hangs past the request timeout
+		if atomic.AddInt32(&requests, 1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+
+		fmt.Fprint(w, `{"entries": [{"user": "alice"}]}`)
+	})
+
+	metrics := NewRGWMetrics(prometheus.NewRegistry())
+	opts := RetryOptions{MaxAttempts: 2, BackoffBase: time.Millisecond, BackoffCap: time.Millisecond}
+	client := withRetries(makeHTTPClient(100*time.Millisecond, nil), opts, metrics.adminAPI.retriesTotal)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	// The request timeout limits each attempt, so the timed out attempt is retried
+	users := []string{}
+	err := getCephUsageStats(context.Background(), client, rgwURL, signer, time.Time{}, func(entry usageEntry) error {
+		users = append(users, entry.User)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice"}, users)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.adminAPI.retriesTotal.WithLabelValues("usage")))
+
+	// A cancelled request isn't retried
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	atomic.StoreInt32(&requests, 0)
+	err = getCephUsageStats(ctx, client, rgwURL, signer, time.Time{}, func(entry usageEntry) error { return nil })
+	require.Error(t, err)
+	require.True(t, isTimeoutError(err))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	opts := RetryOptions{BackoffBase: time.Second, BackoffCap: 5 * time.Second, Jitter: 0.5}
+
+	require.Equal(t, time.Second, opts.backoff(1, 0))
+	require.Equal(t, 2*time.Second, opts.backoff(2, 0))
+	require.Equal(t, 4*time.Second, opts.backoff(3, 0))
+	require.Equal(t, 5*time.Second, opts.backoff(4, 0))
+	require.Equal(t, 5*time.Second, opts.backoff(100, 0))
+
+	// Jitter shortens the delay by up to half
+	require.Equal(t, 2500*time.Millisecond, opts.backoff(100, 1))
+	require.Equal(t, 1500*time.Millisecond, opts.backoff(2, 0.5))
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// secretReader reads secrets that can be given either directly, or as the path of a file containing them
+// IE, RGW_EXPORTER_SECRET_KEY or RGW_EXPORTER_SECRET_KEY_FILE. The latter keeps the secret out of the process
+// environment, and works with Kubernetes and Docker secrets
+type secretReader struct {
+	// files are the paths of all the files that were read, so they can be watched for changes
+	files []string
+}
+
+// read returns `value`, or the contents of `file` if it is set
+// `field` and `fileField` are the names of the settings, used in error messages
+func (r *secretReader) read(field string, value string, fileField string, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("only one of %s and %s can be set", field, fileField)
+	}
+
+	contents, err := r.readFile(fileField, file)
+	if err != nil {
+		return "", err
+	}
+
+	// Files usually end with a newline, which is never part of the secret
+	secret := strings.TrimRight(string(contents), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s `%s` is empty", fileField, file)
+	}
+
+	return secret, nil
+}
+
+// readFile returns the contents of `file`, and watches it for changes
+// `fileField` is the name of the setting, used in error messages
+func (r *secretReader) readFile(fileField string, file string) ([]byte, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s `%s` - %w", fileField, file, err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s `%s` - %w", fileField, file, err)
+	}
+
+	r.files = append(r.files, path)
+	return contents, nil
+}
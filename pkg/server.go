@@ -2,6 +2,9 @@ package pkg
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,77 +15,34 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
-	"github.com/xhit/go-str2duration"
-)
-
-const (
-	viperLogLevel  = "log_level"
-	viperPort      = "port"
-	viperRGWURL    = "rgw_url"
-	viperInterval  = "interval"
-	viperAccessKey = "access_key"
-	viperSecretKey = "secret_key"
+	"github.com/spf13/pflag"
 )
 
 func RunServer() (*logrus.Logger, error) {
-	// Initialize viper
-	v := viper.New()
-	v.SetEnvPrefix("RGW_EXPORTER")
-
-	// Initialize the input defaults
-	v.SetDefault(viperLogLevel, logrus.InfoLevel.String())
-	v.SetDefault(viperPort, 8080)
-	v.SetDefault(viperRGWURL, "")
-	v.SetDefault(viperInterval, "1m")
-	v.SetDefault(viperAccessKey, "")
-	v.SetDefault(viperSecretKey, "")
-
-	// Read them from ENV
-	v.AutomaticEnv()
-
-	// Create a logger
 	log := logrus.New()
-	logLevelStr := v.GetString(viperLogLevel)
-	logLevel, err := logrus.ParseLevel(logLevelStr)
-	if err != nil {
-		return log, fmt.Errorf("failed to parse RGW_EXPORTER_CEPH_URL `%s` - %w", logLevelStr, err)
-	}
-
-	log.SetLevel(logLevel)
-
-	// Validate the inputs
-	rgwURLStr := v.GetString(viperRGWURL)
-	if rgwURLStr == "" {
-		return log, fmt.Errorf("RGW_EXPORTER_CEPH_URL is a required argument")
-	}
+	args := os.Args[1:]
 
-	rgwURL, err := url.Parse(rgwURLStr)
+	// Initialize viper from the flags, ENV, and the config file
+	v, err := newViper(args)
 	if err != nil {
-		return log, fmt.Errorf("failed to parse RGW_EXPORTER_CEPH_URL `%s` - %w", rgwURLStr, err)
-	}
-
-	intervalStr := v.GetString(viperInterval)
-	if intervalStr == "" {
-		return log, fmt.Errorf("RGW_EXPORTER_INTERVAL is a required argument")
+		if errors.Is(err, pflag.ErrHelp) {
+			return log, nil
+		}
+		return log, err
 	}
 
-	interval, err := str2duration.Str2Duration(intervalStr)
+	// Validate the inputs
+	cfg, err := loadConfig(v)
 	if err != nil {
-		return log, fmt.Errorf("failed to parse RGW_EXPORTER_INTERVAL `%s` as a duration - %w", intervalStr, err)
+		return log, err
 	}
 
-	accessKey := v.GetString(viperAccessKey)
-	if accessKey == "" {
-		return log, fmt.Errorf("RGW_EXPORTER_ACCESS_KEY is a required argument")
-	}
-
-	secretKey := v.GetString(viperSecretKey)
-	if secretKey == "" {
-		return log, fmt.Errorf("RGW_EXPORTER_SECRET_KEY is a required argument")
-	}
+	log.SetLevel(cfg.logLevel)
 
 	// Start the server
 	serverCtx, serverCancel := context.WithCancel(context.Background())
@@ -90,12 +50,58 @@ func RunServer() (*logrus.Logger, error) {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	srv, err := startServer(serverCtx, log, rgwURL, accessKey, secretKey, v.GetInt(viperPort), interval)
+	// The config is reloaded on SIGHUP, or when the config file changes
+	reload := make(chan struct{}, 1)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			log.Info("Got SIGHUP, reloading the config")
+			requestReload(reload)
+		}
+	}()
+
+	if v.ConfigFileUsed() != "" {
+		v.OnConfigChange(func(event fsnotify.Event) {
+			log.Infof("Config file changed (%s), reloading the config", event.Op)
+			requestReload(reload)
+		})
+		v.WatchConfig()
+	}
+
+	// All the targets share a single registry. Each target's metrics are told apart by their `cluster` label, and any user defined labels
+	registry := prometheus.NewRegistry()
+
+	// The config is also reloaded when any of the files the secrets were read from changes
+	secretWatcher, err := newFileWatcher(log, func() {
+		log.Info("Secret file changed, reloading the config")
+		requestReload(reload)
+	})
+	if err != nil {
+		serverCancel()
+		return log, err
+	}
+	go secretWatcher.run(serverCtx)
+
+	exp := newExporter(serverCtx, log, registry, args, secretWatcher)
+	exp.applyConfig(cfg)
+
+	srv, err := startServer(serverCtx, log, exp, cfg.port, cfg.webConfigFile)
 	if err != nil {
 		serverCancel()
 		return log, fmt.Errorf("failed to start server - %w", err)
 	}
 
+	go func() {
+		for range reload {
+			if err := exp.reload(); err != nil {
+				log.Errorf("Failed to reload the config. Keeping the current config - %v", err)
+			} else {
+				log.Info("Reloaded the config")
+			}
+		}
+	}()
+
 	// Wait for a signal to shutdown
 	doneSignal := <-done
 	log.Debugf("Got %v signal", doneSignal)
@@ -123,26 +129,34 @@ func RunServer() (*logrus.Logger, error) {
 	return log, nil
 }
 
-func startServer(ctx context.Context, log *logrus.Logger, rgwURL *url.URL, accessKey string, secretKey string, port int, scrapeInterval time.Duration) (*http.Server, error) {
-	// Create a http client to use for requests
-	client := makeHTTPClient()
-
-	// Create the S3 credentials
-	creds := credentials.NewStaticCredentials(accessKey, secretKey, "")
-
-	// Create the metrics instance and start it scraping
-	metrics := NewRGWMetrics()
-	metrics.StartScraping(ctx, log, client, rgwURL, creds, scrapeInterval)
+// requestReload asks for a config reload, unless one is already pending
+func requestReload(reload chan<- struct{}) {
+	select {
+	case reload <- struct{}{}:
+	default:
+	}
+}
 
-	// Finally create and start the server
+// startServer starts serving the metrics on `port`
+// If `webConfigFile` is set, it is used to enable TLS and basic auth, in the format of the Prometheus exporter-toolkit
+func startServer(ctx context.Context, log *logrus.Logger, exp *exporter, port int, webConfigFile string) (*http.Server, error) {
+	// Create and start the server
 	srv := &http.Server{
 		Addr:        fmt.Sprintf(":%d", port),
-		Handler:     createRouter(log, client, rgwURL, metrics),
+		Handler:     createRouter(log, exp.checkReadiness, exp.probeModules, exp.registry),
 		BaseContext: func(_ net.Listener) context.Context { return ctx },
 	}
 
+	listenAddresses := []string{srv.Addr}
+	systemdSocket := false
+	flags := &web.FlagConfig{
+		WebListenAddresses: &listenAddresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}
+
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := web.ListenAndServe(srv, flags, kitLogger{log: log}); err != nil && err != http.ErrServerClosed {
 			log.Errorf("Failed to start listening server - %v", err)
 		}
 	}()
@@ -151,8 +165,39 @@ func startServer(ctx context.Context, log *logrus.Logger, rgwURL *url.URL, acces
 	return srv, nil
 }
 
-func makeHTTPClient() *http.Client {
+// kitLogger sends the logs of the exporter-toolkit, which uses go-kit, to logrus
+type kitLogger struct {
+	log *logrus.Logger
+}
+
+func (l kitLogger) Log(keyvals ...interface{}) error {
+	level := logrus.InfoLevel
+	msg := ""
+	fields := logrus.Fields{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		switch key {
+		case "level":
+			if parsed, err := logrus.ParseLevel(fmt.Sprint(keyvals[i+1])); err == nil {
+				level = parsed
+			}
+		case "msg":
+			msg = fmt.Sprint(keyvals[i+1])
+		default:
+			fields[key] = keyvals[i+1]
+		}
+	}
+
+	l.log.WithFields(fields).Log(level, msg)
+	return nil
+}
+
+// makeHTTPClient creates the client used for all requests to RGW
+// Each request, including reading the response body, is limited to `requestTimeout`. 0 doesn't limit them
+// A nil `tlsConfig` uses the default TLS settings
+func makeHTTPClient(requestTimeout time.Duration, tlsConfig *tls.Config) *http.Client {
 	return &http.Client{
+		Timeout: requestTimeout,
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
@@ -164,6 +209,7 @@ func makeHTTPClient() *http.Client {
 			MaxIdleConnsPerHost:   100,
 			IdleConnTimeout:       10 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
+			TLSClientConfig:       tlsConfig,
 			ExpectContinueTimeout: 1 * time.Second,
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -180,26 +226,29 @@ func makeHTTPClient() *http.Client {
 	}
 }
 
-func createRouter(log *logrus.Logger, client *http.Client, rgwURL *url.URL, metrics *RGWMetrics) http.Handler {
+// createRouter creates the handlers of the server
+// `readiness` and `modules` are called on each request, so they can be reloaded
+func createRouter(log *logrus.Logger, readiness func(ctx context.Context) readinessResponse, modules func() map[string]*probeModule, registry *prometheus.Registry) http.Handler {
 	router := http.NewServeMux()
 
 	// Add the health check handlers
 	// These are used by systems like kubernetes to check if the container is still alive and well
 	router.HandleFunc("/readiness", func(w http.ResponseWriter, r *http.Request) {
 		// Readiness determines if the service is *actually* able to serve real data
-		// So we check the health of our connection to ceph, and if that passes
-		// we return 200
+		// So we check the health of our connection to every ceph target, and optionally that their
+		// collectors are scraping successfully. If they all pass we return 200
 
-		if err := cephHealthCheck(r.Context(), client, rgwURL); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err := w.Write([]byte(fmt.Sprintf("Ceph Health check failed - %v", err))); err != nil {
-				log.Errorf("Failed writing readiness failure - %v", err)
-			}
-		} else {
+		resp := readiness(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		if resp.Ready {
 			w.WriteHeader(http.StatusOK)
-			if _, err := w.Write([]byte("ready")); err != nil {
-				log.Errorf("Failed writing readiness success - %v", err)
-			}
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Failed writing readiness response - %v", err)
 		}
 	})
 	router.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
@@ -215,7 +264,12 @@ func createRouter(log *logrus.Logger, client *http.Client, rgwURL *url.URL, metr
 	})
 
 	// Add the main metrics handler
-	router.Handle("/metrics", metrics.Handler())
+	router.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	))
+
+	// Add the probe handler, which scrapes the RGW instance given in the request instead of the configured targets
+	router.Handle("/probe", probeHandler(log, modules))
 
 	return router
 }
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStartServerBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	webConfigFile := filepath.Join(t.TempDir(), "web-config.yml")
+	require.NoError(t, os.WriteFile(webConfigFile, []byte(fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash)), 0o600))
+
+	// Find a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logrus.New()
+	exp := newExporter(ctx, log, prometheus.NewRegistry(), nil, nil)
+	srv, err := startServer(ctx, log, exp, port, webConfigFile)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	get := func(user string, password string) int {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/metrics", port), nil)
+		require.NoError(t, err)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, http.StatusUnauthorized, get("", ""))
+	require.Equal(t, http.StatusUnauthorized, get("prometheus", "wrong"))
+	require.Equal(t, http.StatusOK, get("prometheus", "password"))
+}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	signatureV2 = "v2"
+	signatureV4 = "v4"
+
+	// defaultSigningRegion is accepted by RGW zonegroups that don't set an api_name
+	defaultSigningRegion = "us-east-1"
+)
+
+// requestSigner signs the requests to the admin API
+type requestSigner struct {
+	creds *credentials.Credentials
+	// region is only used by v4 signatures. It must match the api_name of the RGW zonegroup
+	region string
+	// version is either signatureV2 or signatureV4
+	version string
+}
+
+func newRequestSigner(creds *credentials.Credentials, region string, version string) *requestSigner {
+	return &requestSigner{
+		creds:   creds,
+		region:  region,
+		version: version,
+	}
+}
+
+// signingConfig selects how the admin API requests are signed
+type signingConfig struct {
+	// SigningRegion must match the api_name of the RGW zonegroup
+	SigningRegion    string `mapstructure:"signing_region"`
+	SignatureVersion string `mapstructure:"signature_version"`
+}
+
+// inherit returns the config, with the settings that aren't set taken from `parent`
+func (c signingConfig) inherit(parent signingConfig) signingConfig {
+	if c.SigningRegion == "" {
+		c.SigningRegion = parent.SigningRegion
+	}
+	if c.SignatureVersion == "" {
+		c.SignatureVersion = parent.SignatureVersion
+	}
+
+	return c
+}
+
+// newSigner validates the config and creates the signer that uses `creds`
+// `field` is the name of the setting, used in error messages
+func (c signingConfig) newSigner(field func(key string) string, creds *credentials.Credentials) (*requestSigner, error) {
+	if c.SignatureVersion != signatureV2 && c.SignatureVersion != signatureV4 {
+		return nil, fmt.Errorf("%s `%s` is not one of [%s, %s]", field("signature_version"), c.SignatureVersion, signatureV2, signatureV4)
+	}
+	if c.SignatureVersion == signatureV4 && c.SigningRegion == "" {
+		return nil, fmt.Errorf("%s is a required argument", field("signing_region"))
+	}
+
+	return newRequestSigner(creds, c.SigningRegion, c.SignatureVersion), nil
+}
+
+// sign adds the signature of `req`, made at `now`, to its headers
+func (s *requestSigner) sign(req *http.Request, now time.Time) error {
+	if s.version == signatureV2 {
+		return s.signV2(req, now)
+	}
+
+	_, err := v4.NewSigner(s.creds).Sign(req, nil, "s3", s.region, now)
+	return err
+}
+
+// s3SubResources are the query parameters that are part of the signed resource of v2 signatures
+var s3SubResources = map[string]bool{
+	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
+	"location":                     true,
+	"logging":                      true,
+	"notification":                 true,
+	"partNumber":                   true,
+	"policy":                       true,
+	"requestPayment":               true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"restore":                      true,
+	"tagging":                      true,
+	"torrent":                      true,
+	"uploadId":                     true,
+	"uploads":                      true,
+	"versionId":                    true,
+	"versioning":                   true,
+	"versions":                     true,
+	"website":                      true,
+}
+
+// signV2 signs `req` with the legacy AWS signature version 2, as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/RESTAuthentication.html
+func (s *requestSigner) signV2(req *http.Request, now time.Time) error {
+	value, err := s.creds.GetWithContext(req.Context())
+	if err != nil {
+		return err
+	}
+
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	}
+	if value.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", value.SessionToken)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+	}, "\n") + "\n" + canonicalAmzHeaders(req.Header) + canonicalResource(req)
+
+	mac := hmac.New(sha1.New, []byte(value.SecretAccessKey))
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS %s:%s", value.AccessKeyID, signature))
+	return nil
+}
+
+// canonicalAmzHeaders returns the x-amz-* headers, lowercased and sorted, one per line
+func canonicalAmzHeaders(header http.Header) string {
+	names := []string{}
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+
+	var builder strings.Builder
+	for _, name := range names {
+		values := make([]string, len(header[name]))
+		for i, value := range header[name] {
+			values[i] = strings.TrimSpace(value)
+		}
+
+		builder.WriteString(strings.ToLower(name))
+		builder.WriteString(":")
+		builder.WriteString(strings.Join(values, ","))
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// canonicalResource returns the path of `req`, followed by its sub-resources, if any
+// Other query parameters, like the ones of the admin API, are not signed
+func canonicalResource(req *http.Request) string {
+	query := req.URL.Query()
+
+	keys := []string{}
+	for key := range query {
+		if s3SubResources[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	resource := req.URL.EscapedPath()
+	for i, key := range keys {
+		if i == 0 {
+			resource += "?"
+		} else {
+			resource += "&"
+		}
+
+		resource += key
+		if value := query.Get(key); value != "" {
+			resource += "=" + value
+		}
+	}
+
+	return resource
+}
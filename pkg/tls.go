@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// tlsConfig is the TLS configuration of the connections to RGW
+type tlsConfig struct {
+	// CAFile is a PEM bundle of the CAs used to verify the RGW certificate, instead of the system CAs
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are the client certificate and key presented to RGW, for mTLS
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ServerName overrides the name used to verify the RGW certificate
+	ServerName string `mapstructure:"server_name"`
+	// InsecureSkipVerify disables the verification of the RGW certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// newTLSConfig creates the TLS config described by cfg. It returns nil if cfg doesn't change the defaults
+// The files are read with `secrets`, so the config is reloaded when they change
+// `field` is the name of the setting, used in error messages
+func newTLSConfig(cfg *tlsConfig, field func(key string) string, secrets *secretReader) (*tls.Config, error) {
+	if cfg == nil || *cfg == (tlsConfig{}) {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		caPEM, err := secrets.readFile(field("ca_file"), cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%s `%s` doesn't contain any PEM certificates", field("ca_file"), cfg.CAFile)
+		}
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", field("cert_file"), field("key_file"))
+	}
+
+	if cfg.CertFile != "" {
+		certPEM, err := secrets.readFile(field("cert_file"), cfg.CertFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keyPEM, err := secrets.readFile(field("key_file"), cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s `%s` and %s `%s` - %w", field("cert_file"), cfg.CertFile, field("key_file"), cfg.KeyFile, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
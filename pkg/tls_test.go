@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to `dir`
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rgw-exporter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return cert, certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	rgwURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	healthCheck := func(cfg *tlsConfig) error {
+		secrets := &secretReader{}
+		config, err := newTLSConfig(cfg, func(key string) string { return "tls." + key }, secrets)
+		require.NoError(t, err)
+
+		return cephHealthCheck(context.Background(), makeHTTPClient(time.Minute, config), rgwURL)
+	}
+
+	// The test server's certificate is only trusted with the CA bundle, and the client certificate is required
+	require.Error(t, healthCheck(nil))
+	require.Error(t, healthCheck(&tlsConfig{CAFile: caFile}))
+	require.NoError(t, healthCheck(&tlsConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}))
+	require.NoError(t, healthCheck(&tlsConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}))
+
+	// The test server's certificate is valid for example.com
+	require.NoError(t, healthCheck(&tlsConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}))
+	require.Error(t, healthCheck(&tlsConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "other.example.org"}))
+
+	// The files are watched for changes
+	secrets := &secretReader{}
+	_, err = newTLSConfig(&tlsConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, func(key string) string { return key }, secrets)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{caFile, certFile, keyFile}, secrets.files)
+
+	_, err = newTLSConfig(&tlsConfig{CertFile: certFile}, func(key string) string { return key }, secrets)
+	require.Error(t, err)
+}
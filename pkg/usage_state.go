@@ -0,0 +1,294 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// usageSettleDelay is how long after the end of an hour its usage log entries are considered final
+// RGW flushes the usage log periodically, so the entries of an hour can still change shortly after it ends
+const usageSettleDelay = 5 * time.Minute
+
+// usageKey identifies the usage counters of a bucket category
+// The usage summary of a user only has an Owner
+type usageKey struct {
+	Owner    string
+	Bucket   string
+	Category string
+}
+
+type usageValue struct {
+	OpsTotal           int64 `json:"ops"`
+	OpsSuccessful      int64 `json:"successful_ops"`
+	SentBytesTotal     int64 `json:"bytes_sent"`
+	ReceivedBytesTotal int64 `json:"bytes_received"`
+}
+
+// plus returns the sum of both values
+func (v usageValue) plus(other usageValue) usageValue {
+	return usageValue{
+		OpsTotal:           v.OpsTotal + other.OpsTotal,
+		OpsSuccessful:      v.OpsSuccessful + other.OpsSuccessful,
+		SentBytesTotal:     v.SentBytesTotal + other.SentBytesTotal,
+		ReceivedBytesTotal: v.ReceivedBytesTotal + other.ReceivedBytesTotal,
+	}
+}
+
+// decreaseTo returns how much each counter decreased from `v` to `current`, or zero for the counters that didn't decrease
+func (v usageValue) decreaseTo(current usageValue) usageValue {
+	decrease := func(previous int64, current int64) int64 {
+		if current < previous {
+			return previous - current
+		}
+		return 0
+	}
+
+	return usageValue{
+		OpsTotal:           decrease(v.OpsTotal, current.OpsTotal),
+		OpsSuccessful:      decrease(v.OpsSuccessful, current.OpsSuccessful),
+		SentBytesTotal:     decrease(v.SentBytesTotal, current.SentBytesTotal),
+		ReceivedBytesTotal: decrease(v.ReceivedBytesTotal, current.ReceivedBytesTotal),
+	}
+}
+
+// usageTotals are the usage counters of each bucket category
+type usageTotals map[usageKey]usageValue
+
+// add adds the counters of a usage log category entry
+func (t usageTotals) add(key usageKey, category usageCategoryEntry) {
+	value := t[key]
+
+	value.OpsTotal += category.Ops
+	value.OpsSuccessful += category.SuccessfulOps
+	value.SentBytesTotal += category.BytesSent
+	value.ReceivedBytesTotal += category.BytesReceived
+
+	t[key] = value
+}
+
+// merge adds all the counters of `other`
+func (t usageTotals) merge(other usageTotals) {
+	for key, otherValue := range other {
+		t[key] = t[key].plus(otherValue)
+	}
+}
+
+// hourlyUsage is the usage of a single hour of the usage log
+type hourlyUsage struct {
+	// Hour is the start of the hour
+	Hour  time.Time
+	Usage usageTotals
+}
+
+// add adds the usage of a usage log bucket entry, if it covers the hour. It does nothing on a nil hourlyUsage
+func (h *hourlyUsage) add(owner string, bucket bucketUsageEntry) {
+	if h == nil || bucket.Epoch != h.Hour.Unix() {
+		return
+	}
+
+	for _, category := range bucket.Categories {
+		h.Usage.add(usageKey{Owner: owner, Bucket: bucket.ID, Category: category.Name}, category)
+	}
+}
+
+// usageBaseline keeps the counters of a bucket category monotonic when the usage log is trimmed
+type usageBaseline struct {
+	// Offset is the usage that was trimmed from the usage log, and is added to the usage that is left
+	Offset usageValue
+	// Last is the usage of the last scrape the bucket category was in, before adding Offset
+	Last usageValue
+	// LastSeen is the last time the bucket category was in the usage log
+	LastSeen time.Time
+}
+
+// usageState is the usage accumulated by the operations collector
+type usageState struct {
+	// Watermark is the start of the first hour that isn't accumulated in Totals yet. Zero means nothing was accumulated
+	Watermark time.Time
+	// Totals is the usage of all the hours before Watermark, in the incremental mode
+	Totals usageTotals
+	// Baselines are the baselines of the bucket categories scraped within the retention
+	Baselines map[usageKey]usageBaseline
+}
+
+// keepMonotonic adds the baselines to the usage of a scrape, so the counters never decrease
+// When a counter decreases, IE because the usage log was trimmed, the decrease is added to its offset. Bucket categories
+// that are missing from the usage aren't exported, but their baselines are kept for `retention`, so their counters carry
+// on if they come back. Zero keeps them forever. It returns the adjusted usage, the number of bucket categories whose
+// counters decreased, and the number of baselines that were dropped
+func (s *usageState) keepMonotonic(usage usageTotals, now time.Time, retention time.Duration) (usageTotals, int, int) {
+	adjusted := usageTotals{}
+	trimmed := 0
+	pruned := 0
+
+	for key, baseline := range s.Baselines {
+		if _, ok := usage[key]; ok {
+			continue
+		}
+
+		if baseline.LastSeen.IsZero() {
+			// Saved before the baselines had a last seen time
+			baseline.LastSeen = now
+			s.Baselines[key] = baseline
+		}
+		if retention > 0 && now.Sub(baseline.LastSeen) > retention {
+			delete(s.Baselines, key)
+			pruned++
+		}
+	}
+
+	for key, value := range usage {
+		baseline := s.Baselines[key]
+
+		decrease := baseline.Last.decreaseTo(value)
+		if decrease != (usageValue{}) {
+			trimmed++
+			baseline.Offset = baseline.Offset.plus(decrease)
+		}
+		baseline.Last = value
+		baseline.LastSeen = now
+
+		s.Baselines[key] = baseline
+		adjusted[key] = baseline.Offset.plus(value)
+	}
+
+	return adjusted, trimmed, pruned
+}
+
+// usageStateFile is the on-disk format of a usageState
+type usageStateFile struct {
+	Version   int                  `json:"version"`
+	Watermark time.Time            `json:"watermark"`
+	Totals    []usageStateEntry    `json:"totals"`
+	Baselines []usageBaselineEntry `json:"baselines"`
+}
+
+type usageStateEntry struct {
+	Owner    string `json:"owner"`
+	Bucket   string `json:"bucket"`
+	Category string `json:"category"`
+	usageValue
+}
+
+type usageBaselineEntry struct {
+	Owner    string     `json:"owner"`
+	Bucket   string     `json:"bucket"`
+	Category string     `json:"category"`
+	Offset   usageValue `json:"offset"`
+	Last     usageValue `json:"last"`
+	LastSeen time.Time  `json:"last_seen"`
+}
+
+const usageStateVersion = 1
+
+// usageStatePath returns the path of the usage state file of the target named `name`, in `dir`
+// It returns an empty path if `dir` is empty, which disables the state file
+func usageStatePath(dir string, name string) string {
+	if dir == "" {
+		return ""
+	}
+	if name == "" {
+		return filepath.Join(dir, "usage.json")
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("usage-%s.json", url.PathEscape(name)))
+}
+
+// loadUsageState reads the usage state saved in `path`
+// It returns an empty state if `path` is empty, or doesn't exist yet
+func loadUsageState(path string) (*usageState, error) {
+	state := &usageState{Totals: usageTotals{}, Baselines: map[usageKey]usageBaseline{}}
+	if path == "" {
+		return state, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage state file `%s` - %w", path, err)
+	}
+
+	file := usageStateFile{}
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse usage state file `%s` - %w", path, err)
+	}
+	if file.Version != usageStateVersion {
+		return nil, fmt.Errorf("usage state file `%s` has unsupported version %d", path, file.Version)
+	}
+
+	state.Watermark = file.Watermark
+	for _, entry := range file.Totals {
+		state.Totals[usageKey{Owner: entry.Owner, Bucket: entry.Bucket, Category: entry.Category}] = entry.usageValue
+	}
+	for _, entry := range file.Baselines {
+		state.Baselines[usageKey{Owner: entry.Owner, Bucket: entry.Bucket, Category: entry.Category}] = usageBaseline{
+			Offset:   entry.Offset,
+			Last:     entry.Last,
+			LastSeen: entry.LastSeen,
+		}
+	}
+
+	return state, nil
+}
+
+// save writes the state to `path`. The file is replaced atomically, so a crash never leaves a partial state
+func (s *usageState) save(path string) error {
+	file := usageStateFile{
+		Version:   usageStateVersion,
+		Watermark: s.Watermark,
+		Totals:    make([]usageStateEntry, 0, len(s.Totals)),
+		Baselines: make([]usageBaselineEntry, 0, len(s.Baselines)),
+	}
+	for key, value := range s.Totals {
+		file.Totals = append(file.Totals, usageStateEntry{
+			Owner:      key.Owner,
+			Bucket:     key.Bucket,
+			Category:   key.Category,
+			usageValue: value,
+		})
+	}
+	for key, baseline := range s.Baselines {
+		file.Baselines = append(file.Baselines, usageBaselineEntry{
+			Owner:    key.Owner,
+			Bucket:   key.Bucket,
+			Category: key.Category,
+			Offset:   baseline.Offset,
+			Last:     baseline.Last,
+			LastSeen: baseline.LastSeen,
+		})
+	}
+
+	contents, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage state - %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create usage state file - %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(contents)
+	closeErr := tmp.Close()
+
+	if err != nil {
+		return fmt.Errorf("failed to write usage state file `%s` - %w", tmp.Name(), err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close usage state file `%s` - %w", tmp.Name(), closeErr)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace usage state file `%s` - %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUsageLog serves the hourly usage entries of a single bucket, honouring the `start` parameter
+type fakeUsageLog struct {
+	mu sync.Mutex
+	// ops are the ops of each hour
+	ops map[time.Time]int64
+	// starts are the `start` parameters of the requests
+	starts []string
+}
+
+func (l *fakeUsageLog) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		startStr := r.URL.Query().Get("start")
+		l.starts = append(l.starts, startStr)
+
+		var start time.Time
+		if startStr != "" {
+			var err error
+			start, err = time.Parse(usageTimeFormat, startStr)
+			require.NoError(t, err)
+		}
+
+		buckets := []bucketUsageEntry{}
+		for epoch, ops := range l.ops {
+			if epoch.Before(start) {
+				continue
+			}
+
+			buckets = append(buckets, bucketUsageEntry{
+				ID:         "photos",
+				Owner:      "alice",
+				Epoch:      epoch.Unix(),
+				Categories: []usageCategoryEntry{{Name: "get_obj", Ops: ops}},
+			})
+		}
+
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": []usageEntry{{User: "alice", Buckets: buckets}},
+		}))
+	}
+}
+
+func TestIncrementalUsage(t *testing.T) {
+	hour := func(h int) time.Time { return time.Date(2023, time.July, 1, h, 0, 0, 0, time.UTC) }
+
+	usageLog := &fakeUsageLog{ops: map[time.Time]int64{hour(10): 1, hour(11): 2, hour(12): 4}}
+	rgwURL := newFakeRGW(t, usageLog.handler(t))
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{
+		Ops:            CollectorOptions{Enabled: true, Incremental: true},
+		UsageStateFile: filepath.Join(t.TempDir(), "usage.json"),
+	}
+	key := usageKey{Owner: "alice", Bucket: "photos", Category: "get_obj"}
+
+	collector := NewRGWMetrics(prometheus.NewRegistry()).ops
+	scrape := func(now time.Time) int64 {
+		totals, _, err := collector.scrapeUsage(context.Background(), logrus.New(), client, rgwURL, signer, opts, now)
+		require.NoError(t, err)
+		return totals[key].OpsTotal
+	}
+
+	// The first scrape fetches the whole usage log. The current hour isn't accumulated yet
+	require.Equal(t, int64(7), scrape(hour(12).Add(30*time.Minute)))
+	require.Equal(t, hour(12), collector.usage.Watermark)
+	require.Equal(t, int64(3), collector.usage.Totals[key].OpsTotal)
+
+	// The following scrapes only fetch the hours from the watermark
+	usageLog.mu.Lock()
+	usageLog.ops[hour(12)] = 5
+	usageLog.ops[hour(13)] = 8
+	usageLog.mu.Unlock()
+
+	require.Equal(t, int64(16), scrape(hour(13).Add(10*time.Minute)))
+	require.Equal(t, hour(13), collector.usage.Watermark)
+
+	// The state is loaded from the file after a restart, and the counters carry on from where they were
+	collector = NewRGWMetrics(prometheus.NewRegistry()).ops
+	require.Equal(t, int64(16), scrape(hour(13).Add(20*time.Minute)))
+
+	require.Equal(t, []string{"", "2023-07-01 12:00:00", "2023-07-01 13:00:00"}, usageLog.starts)
+}
+
+func TestUsageTrims(t *testing.T) {
+	hour := func(h int) time.Time { return time.Date(2023, time.July, 1, h, 0, 0, 0, time.UTC) }
+
+	usageLog := &fakeUsageLog{ops: map[time.Time]int64{hour(10): 5, hour(11): 3}}
+	rgwURL := newFakeRGW(t, usageLog.handler(t))
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{
+		Ops:            CollectorOptions{Enabled: true},
+		UsageStateFile: filepath.Join(t.TempDir(), "usage.json"),
+		StateRetention: 24 * time.Hour,
+	}
+	key := usageKey{Owner: "alice", Bucket: "photos", Category: "get_obj"}
+
+	now := hour(13)
+	collector := NewRGWMetrics(prometheus.NewRegistry()).ops
+	scrapeTotals := func() usageTotals {
+		totals, _, err := collector.scrapeUsage(context.Background(), logrus.New(), client, rgwURL, signer, opts, now)
+		require.NoError(t, err)
+		return totals
+	}
+	scrape := func() int64 {
+		return scrapeTotals()[key].OpsTotal
+	}
+	setOps := func(ops map[time.Time]int64) {
+		usageLog.mu.Lock()
+		defer usageLog.mu.Unlock()
+		usageLog.ops = ops
+	}
+
+	require.Equal(t, int64(8), scrape())
+
+	// Trimming the usage log doesn't decrease the counters, and the following usage is added on top
+	setOps(map[time.Time]int64{hour(11): 3})
+	require.Equal(t, int64(8), scrape())
+
+	setOps(map[time.Time]int64{hour(11): 3, hour(12): 4})
+	require.Equal(t, int64(12), scrape())
+
+	// The baselines are loaded from the file after a restart
+	collector = NewRGWMetrics(prometheus.NewRegistry()).ops
+	require.Equal(t, int64(12), scrape())
+
+	// Bucket categories that are trimmed entirely aren't exported, but their counters carry on if they come back
+	setOps(map[time.Time]int64{})
+	require.NotContains(t, scrapeTotals(), key)
+
+	now = now.Add(time.Hour)
+	setOps(map[time.Time]int64{hour(14): 2})
+	require.Equal(t, int64(12), scrape())
+
+	setOps(map[time.Time]int64{hour(14): 3})
+	require.Equal(t, int64(13), scrape())
+
+	// The baselines of the bucket categories that are missing for longer than the retention are dropped
+	setOps(map[time.Time]int64{})
+	require.NotContains(t, scrapeTotals(), key)
+	require.Contains(t, collector.usage.Baselines, key)
+
+	now = now.Add(25 * time.Hour)
+	require.NotContains(t, scrapeTotals(), key)
+	require.NotContains(t, collector.usage.Baselines, key)
+
+	// The state file doesn't keep them either
+	collector = NewRGWMetrics(prometheus.NewRegistry()).ops
+	setOps(map[time.Time]int64{hour(14): 3})
+	require.Equal(t, int64(3), scrape())
+}
+
+func TestHourlyUsage(t *testing.T) {
+	// The most recent complete hour
+	hour := time.Now().Add(-usageSettleDelay).Truncate(time.Hour).Add(-time.Hour)
+
+	usageLog := &fakeUsageLog{ops: map[time.Time]int64{hour.Add(-time.Hour): 1, hour: 2, hour.Add(time.Hour): 4}}
+	rgwURL := newFakeRGW(t, usageLog.handler(t))
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+
+	for _, incremental := range []bool{false, true} {
+		collector := NewRGWMetrics(prometheus.NewRegistry()).ops
+		opts := ScrapeOptions{Ops: CollectorOptions{Enabled: true, Incremental: incremental, Hourly: true}}
+
+		// From the second incremental scrape onwards, the watermark is after the hour, which must still be fetched
+		for i := 0; i < 2; i++ {
+			before := time.Now()
+			require.NoError(t, collector.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+
+			ch := make(chan prometheus.Metric, 100)
+			collector.Collect(ch)
+			close(ch)
+
+			found := false
+			for metric := range ch {
+				written := &dto.Metric{}
+				require.NoError(t, metric.Write(written))
+
+				switch metric.Desc() {
+				case collector.hourlyOps:
+					// The samples are timestamped with the scrape, which Prometheus accepts regardless of the hour
+					require.Equal(t, 2.0, written.GetGauge().GetValue())
+					require.GreaterOrEqual(t, written.GetTimestampMs(), before.UnixMilli())
+					found = true
+				case collector.hourlyStartTimestamp:
+					require.Equal(t, float64(hour.Unix()), written.GetGauge().GetValue())
+				}
+			}
+			require.True(t, found)
+		}
+	}
+}
+
+func TestHourlyUsageWindow(t *testing.T) {
+	hour := func(h int) time.Time { return time.Date(2023, time.July, 1, h, 0, 0, 0, time.UTC) }
+
+	usageLog := &fakeUsageLog{ops: map[time.Time]int64{hour(11): 1, hour(12): 2, hour(13): 4}}
+	rgwURL := newFakeRGW(t, usageLog.handler(t))
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	opts := ScrapeOptions{Ops: CollectorOptions{Enabled: true, Hourly: true}}
+	key := usageKey{Owner: "alice", Bucket: "photos", Category: "get_obj"}
+
+	collector := NewRGWMetrics(prometheus.NewRegistry()).ops
+	scrape := func(now time.Time) *hourlyUsage {
+		_, hourly, err := collector.scrapeUsage(context.Background(), logrus.New(), client, rgwURL, signer, opts, now)
+		require.NoError(t, err)
+		return hourly
+	}
+
+	// An hour is only reported once it has settled, 5 minutes after it ends
+	hourly := scrape(hour(13).Add(usageSettleDelay - time.Second))
+	require.Equal(t, hour(11), hourly.Hour)
+	require.Equal(t, int64(1), hourly.Usage[key].OpsTotal)
+
+	hourly = scrape(hour(13).Add(usageSettleDelay))
+	require.Equal(t, hour(12), hourly.Hour)
+	require.Equal(t, int64(2), hourly.Usage[key].OpsTotal)
+}
+
+func TestSummaryUsage(t *testing.T) {
+	rgwURL := newFakeRGW(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"entries": [{"user": "alice", "buckets": [{"bucket": "photos", "owner": "alice", "categories": [{"category": "get_obj", "ops": 3}]}]}],
+			"summary": [{"user": "alice", "total": {"ops": 3}}]
+		}`)
+	})
+
+	client := makeHTTPClient(time.Minute, nil)
+	signer := newRequestSigner(credentials.NewStaticCredentials("access", "secret", ""), defaultSigningRegion, signatureV4)
+	stateFile := filepath.Join(t.TempDir(), "usage.json")
+
+	collector := NewRGWMetrics(prometheus.NewRegistry()).ops
+	collect := func(summary bool) []string {
+		opts := ScrapeOptions{Ops: CollectorOptions{Enabled: true, Summary: summary}, UsageStateFile: stateFile}
+		require.NoError(t, collector.Scrape(context.Background(), logrus.New(), client, rgwURL, signer, opts))
+
+		ch := make(chan prometheus.Metric, 100)
+		collector.Collect(ch)
+		close(ch)
+
+		names := []string{}
+		for metric := range ch {
+			if metric.Desc() == collector.opsTotal {
+				names = append(names, "bucket")
+			}
+			if metric.Desc() == collector.userOpsTotal {
+				names = append(names, "user")
+			}
+		}
+		return names
+	}
+
+	// The state keeps the usage of both modes, but only the usage of the current mode is exported
+	require.Equal(t, []string{"bucket"}, collect(false))
+	require.Equal(t, []string{"user"}, collect(true))
+	require.Equal(t, []string{"bucket"}, collect(false))
+}
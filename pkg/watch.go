@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// fileWatcher calls onChange when any of the watched files changes
+// The parent directories are watched instead of the files themselves, so files that are replaced are still
+// noticed. This includes Kubernetes Secrets, which are updated by swapping a symlink
+type fileWatcher struct {
+	log      logrus.FieldLogger
+	watcher  *fsnotify.Watcher
+	onChange func()
+
+	mu sync.Mutex
+	// files maps the path of each watched file to the path it resolved to, after following symlinks
+	files map[string]string
+	dirs  map[string]bool
+}
+
+func newFileWatcher(log logrus.FieldLogger, onChange func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher - %w", err)
+	}
+
+	return &fileWatcher{
+		log:      log,
+		watcher:  watcher,
+		onChange: onChange,
+		files:    map[string]string{},
+		dirs:     map[string]bool{},
+	}, nil
+}
+
+// setFiles replaces the watched files with `paths`
+func (w *fileWatcher) setFiles(paths []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := map[string]string{}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		files[path] = resolvePath(path)
+		dirs[filepath.Dir(path)] = true
+	}
+
+	for dir := range dirs {
+		if !w.dirs[dir] {
+			if err := w.watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch `%s` - %w", dir, err)
+			}
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			// The directory may have been removed, in which case it isn't watched anymore anyway
+			_ = w.watcher.Remove(dir)
+		}
+	}
+
+	w.files = files
+	w.dirs = dirs
+	return nil
+}
+
+// run handles the file events until ctx is cancelled
+func (w *fileWatcher) run(ctx context.Context) {
+	defer w.watcher.Close()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.changed(event) {
+				w.onChange()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.log.Errorf("Error while watching files - %v", err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// changed returns true if `event` changed the contents of any of the watched files
+func (w *fileWatcher) changed(event fsnotify.Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := false
+	for path, resolved := range w.files {
+		if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+			changed = true
+		}
+
+		// A symlink somewhere in the path now points to a different file
+		if current := resolvePath(path); current != resolved {
+			w.files[path] = current
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// resolvePath returns `path` with all symlinks followed, or an empty string if it doesn't exist
+func resolvePath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+
+	return resolved
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+
+	// Lay the files out like a Kubernetes Secret volume, where the file is a symlink into a directory that is swapped on update
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "v1"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v1", "secret_key"), []byte("old"), 0o600))
+	require.NoError(t, os.Symlink("v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "secret_key"), filepath.Join(dir, "secret_key")))
+
+	changes := make(chan struct{}, 10)
+	watcher, err := newFileWatcher(logrus.New(), func() { changes <- struct{}{} })
+	require.NoError(t, err)
+	require.NoError(t, watcher.setFiles([]string{filepath.Join(dir, "secret_key")}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.run(ctx)
+
+	waitForChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the change was not noticed")
+		}
+	}
+
+	// Swap the symlink to a new version of the secret
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "v2"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v2", "secret_key"), []byte("new"), 0o600))
+	require.NoError(t, os.Symlink("v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	waitForChange()
+
+	// Plain writes to a regular file are noticed too
+	plainFile := filepath.Join(dir, "access_key")
+	require.NoError(t, os.WriteFile(plainFile, []byte("old"), 0o600))
+	require.NoError(t, watcher.setFiles([]string{plainFile}))
+	require.NoError(t, os.WriteFile(plainFile, []byte("new"), 0o600))
+	waitForChange()
+}